@@ -0,0 +1,30 @@
+// Palette © Albert Bregonia 2021
+package main
+
+import (
+	"Palette/signaling"
+	"encoding/base64"
+)
+
+//SocketChannel is a channel to a user that is sent over their `SignalingSocket` in the form of
+//`{"type": "message", "data": {"channel": "<label>", "data": "..."}}`, used when a WebRTC connection cannot be
+//established. Binary data is base64 encoded and marked with `"binary": true`, see `signaling.ChannelMessage`
+type SocketChannel struct {
+	label  string
+	socket *SignalingSocket
+}
+
+//Label is an accessor for the label of the channel
+func (channel *SocketChannel) Label() string { return channel.label }
+
+//Send sends binary data over the channel
+func (channel *SocketChannel) Send(data []byte) error {
+	_, e := channel.socket.Send(signaling.CHANNEL, 0, signaling.ChannelMessage{Channel: channel.label, Data: base64.StdEncoding.EncodeToString(data), Binary: true})
+	return e
+}
+
+//SendText sends text over the channel
+func (channel *SocketChannel) SendText(text string) error {
+	_, e := channel.socket.Send(signaling.CHANNEL, 0, signaling.ChannelMessage{Channel: channel.label, Data: text})
+	return e
+}
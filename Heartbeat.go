@@ -0,0 +1,115 @@
+// Palette © Albert Bregonia 2021
+package main
+
+import (
+	"Palette/lobby"
+	"Palette/lobby/user"
+	"Palette/signaling"
+	"encoding/json"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+	heartbeat is a goroutine that pings the client of a session every `HEARTBEAT_INTERVAL` until the session is closed.
+
+	The signaling socket is pinged with WebSocket pings, which browsers answer on their own, and fails to read once no
+	pong has arrived for `HEARTBEAT_TIMEOUT`, ending the session. Once the channels of the session are in use, the
+	`events` channel is also pinged with `{"type": "ping", "data": n}`, which the client answers with `{"type": "pong",
+	"data": n}`, as the peer connection can die while the socket is still open. The user is marked disconnected if
+	that pong is late. The session is ended with `signaling.NOT_A_MEMBER` once the user is no longer in the lobby, so
+	that the client stops connecting again. Internal use only!
+*/
+func (session *Session) heartbeat() {
+	ticker := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+	for n := 1; ; n++ {
+		select {
+		case <-session.stop:
+			return
+		case <-session.lobby.Context().Done():
+			session.signaler.Fail(0, signaling.Errorf(signaling.NOT_A_MEMBER, `the lobby was closed`))
+			return
+		case <-ticker.C:
+		}
+		if !session.member() {
+			session.signaler.Fail(0, signaling.Errorf(signaling.NOT_A_MEMBER, `you are no longer in the lobby`))
+			return
+		}
+		if session.signaler.Ping() != nil {
+			session.signaler.Close()
+			return
+		}
+		session.Lock()
+		events, lastPong := session.events, session.lastPong
+		session.Unlock()
+		if events == nil { //the channels of the session are not in use yet
+			continue
+		}
+		ping, _ := json.Marshal(lobby.Event{Type: `ping`, Data: n})
+		events.SendText(string(ping))
+		if time.Since(lastPong) > HEARTBEAT_TIMEOUT {
+			session.alive(false)
+		}
+	}
+}
+
+//member reports whether the user of a session is still in its lobby or waiting for a slot. Internal use only!
+func (session *Session) member() bool {
+	name := session.usr.Name()
+	if session.lobby.GetUser(name) == session.usr {
+		return true
+	}
+	waiting, _ := session.lobby.Waiting(name)
+	return waiting == session.usr
+}
+
+//control handles a message of the `events` channel of a session, pongs are handled by the session and every other
+//message is a control message of the lobby, see `lobby.Control()`. Internal use only!
+func (session *Session) control(data []byte) {
+	event := lobby.Event{}
+	if json.Unmarshal(data, &event) == nil && event.Type == `pong` {
+		session.Lock()
+		session.lastPong = time.Now()
+		session.Unlock()
+		session.alive(true)
+		return
+	}
+	session.lobby.Control(session.usr, data)
+}
+
+//peerStateChanged marks the user of a session disconnected while its peer connection is down, unless the session
+//has fallen back to the socket, which has its own heartbeat. Internal use only!
+func (session *Session) peerStateChanged(state webrtc.PeerConnectionState) {
+	session.Lock()
+	fellBack := session.fellBack
+	session.Unlock()
+	if fellBack {
+		return
+	}
+	switch state {
+	case webrtc.PeerConnectionStateConnected:
+		session.alive(true)
+	case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+		session.alive(false)
+	}
+}
+
+//alive marks the user of a session as disconnected, which starts the lobby's timeout before their data is deleted,
+//or clears it once they have resumed. Only the current session of a user decides whether they are connected.
+//Internal use only!
+func (session *Session) alive(alive bool) {
+	activeSessions.Lock()
+	defer activeSessions.Unlock()
+	if activeSessions.users[session.usr] != session {
+		return
+	}
+	disconnected := session.usr.TimeDisconnect() != user.NIL_TIME
+	switch {
+	case alive && disconnected:
+		session.usr.SetTimeDisconnect(user.NIL_TIME)
+	case !alive && !disconnected:
+		session.usr.SetTimeDisconnect(time.Now())
+	}
+}
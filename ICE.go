@@ -0,0 +1,107 @@
+// Palette © Albert Bregonia 2021
+package main
+
+import (
+	"Palette/voice"
+	"fmt"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+	ICEConfig is the configuration of ICE for the server and every client.
+
+	It is the only place where ICE servers are configured: the server uses them for its own peer connections and the same
+	list is delivered to clients over signaling before the offer, see `SignalingServer()`. The credentials of the built-in
+	TURN/STUN server are added to the list of every session if it is running, see `TURN`.
+
+	LAN-only deployments can leave `Servers` empty and relay-only deployments set `Policy` to relay, which requires at
+	least one TURN server. `MinPort`, `MaxPort` and `NAT1To1IPs` only apply to the server, through pion's `SettingEngine`.
+*/
+type ICEConfig struct {
+	Servers              []webrtc.ICEServer
+	Policy               webrtc.ICETransportPolicy //whether every kind of candidate is allowed or only relayed candidates
+	MinPort, MaxPort     uint16                    //range of UDP ports the server gathers candidates on, any port if both are 0
+	NAT1To1IPs           []string                  //public IPs of the server if it is behind a 1:1 NAT, such as a cloud VM
+	NAT1To1CandidateType webrtc.ICECandidateType   //whether `NAT1To1IPs` replace host candidates or are added as srflx candidates
+}
+
+//api creates the WebRTC API of the server with the settings of the configuration and support for voice chat.
+//Returns an error if the configuration is invalid
+func (ice ICEConfig) api() (*webrtc.API, error) {
+	if ice.Policy == webrtc.ICETransportPolicyRelay && !ice.relayed() {
+		return nil, fmt.Errorf(`invalid ICE configuration: the relay policy requires a TURN server`)
+	}
+	engine := webrtc.SettingEngine{}
+	if ice.MinPort != 0 || ice.MaxPort != 0 {
+		if e := engine.SetEphemeralUDPPortRange(ice.MinPort, ice.MaxPort); e != nil {
+			return nil, fmt.Errorf(`invalid ICE configuration: port range %v-%v: %v`, ice.MinPort, ice.MaxPort, e)
+		}
+	}
+	if len(ice.NAT1To1IPs) > 0 {
+		candidateType := ice.NAT1To1CandidateType
+		if candidateType == 0 { //not set
+			candidateType = webrtc.ICECandidateTypeHost
+		}
+		engine.SetNAT1To1IPs(ice.NAT1To1IPs, candidateType)
+	}
+	media, interceptors := &webrtc.MediaEngine{}, &interceptor.Registry{}
+	if e := voice.Register(media, interceptors); e != nil {
+		return nil, fmt.Errorf(`invalid ICE configuration: %v`, e)
+	}
+	return webrtc.NewAPI(webrtc.WithSettingEngine(engine), webrtc.WithMediaEngine(media), webrtc.WithInterceptorRegistry(interceptors)), nil
+}
+
+//relayed reports whether the configuration includes a TURN server, either configured or built-in
+func (ice ICEConfig) relayed() bool {
+	if turnServer != nil {
+		return true
+	}
+	for _, server := range ice.Servers {
+		for _, url := range server.URLs {
+			if strings.HasPrefix(url, `turn:`) || strings.HasPrefix(url, `turns:`) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//client returns the configuration delivered to the client of a session. If the built-in TURN/STUN
+//server is running, the session is given its own short-lived credentials for it
+func (ice ICEConfig) client(session string) webrtc.Configuration {
+	servers := make([]webrtc.ICEServer, 0, len(ice.Servers)+1)
+	if turnServer != nil {
+		servers = append(servers, turnServer.Credentials(session))
+	}
+	return webrtc.Configuration{
+		ICEServers:         append(servers, ice.Servers...),
+		ICETransportPolicy: ice.Policy,
+	}
+}
+
+//server returns the configuration of the server's side of a session. The server already knows its public
+//address when `NAT1To1IPs` are set, in which case STUN servers are left out as pion does not allow both
+func (ice ICEConfig) server(session string) webrtc.Configuration {
+	config := ice.client(session)
+	if len(ice.NAT1To1IPs) == 0 {
+		return config
+	}
+	servers := make([]webrtc.ICEServer, 0, len(config.ICEServers))
+	for _, server := range config.ICEServers {
+		urls := make([]string, 0, len(server.URLs))
+		for _, url := range server.URLs {
+			if !strings.HasPrefix(url, `stun:`) && !strings.HasPrefix(url, `stuns:`) {
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) > 0 {
+			server.URLs = urls
+			servers = append(servers, server)
+		}
+	}
+	config.ICEServers = servers
+	return config
+}
@@ -3,27 +3,56 @@ package main
 
 import (
 	"Palette/lobby"
+	"Palette/lobby/filter"
 	"Palette/lobby/user"
+	"Palette/record"
+	"Palette/relay"
+	"Palette/signaling"
+	"Palette/timelapse"
 	"embed"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"math"
 	"math/rand"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
+	"github.com/pion/webrtc/v3"
 )
 
 // The Main package handles the web server backend and WebRTC connections
 
 var (
-	MAX_USER_TIMEOUT = 5 * time.Minute
-	manager          = lobby.NewManager()
+	MAX_USER_TIMEOUT   = 5 * time.Minute
+	MAX_CHAT_HISTORY   = 200                      //number of chat messages a lobby keeps for users that join or reconnect later
+	RATE_LIMITS        = lobby.DefaultLimits()    //flood protection budgets for chat, drawing and commands of every lobby
+	WATERMARKS         = user.DefaultWatermarks() //backpressure settings of the outbound queue of every channel, see `user.Queue`
+	HEARTBEAT_INTERVAL = 10 * time.Second         //time between pings on the signaling socket and `events` channel of every session
+	HEARTBEAT_TIMEOUT  = 30 * time.Second         //time without a pong after which a user is considered disconnected
+	manager            = lobby.NewManager()
+	TURN               = relay.Config{Port: 3478} //set `PublicIP` to run the built-in TURN/STUN server
+	turnServer         *relay.Server
+	ICE_TIMEOUT        = 15 * time.Second //time for a WebRTC connection to be established before falling back to WebSockets
+	ICE                = ICEConfig{       //ICE servers and policy of the server and every client, see `ICEConfig`
+		Servers: []webrtc.ICEServer{{URLs: []string{`stun:stun.l.google.com:19302`}}},
+		Policy:  webrtc.ICETransportPolicyAll,
+	}
+	RECORDINGS = record.Config{ //where lobbies are recorded to once their host enables recording, see `record.Config`
+		Directory:     `recordings`,
+		MaxAge:        30 * 24 * time.Hour,
+		MaxRecordings: 100,
+		MaxBytes:      10 << 30,
+	}
+	TIMELAPSE          = timelapse.DefaultOptions() //size and pacing of the time-lapse GIFs of whiteboards
+	TIMELAPSE_INTERVAL = 10 * time.Second           //minimum time between renders of the time-lapse of a lobby, see `renderTimelapse()`
 )
 
 var (
@@ -42,6 +71,26 @@ func main() {
 	http.HandleFunc(`/reconnect`, ReconnectHandler)
 	http.HandleFunc(`/login`, LoginHandler)
 	http.HandleFunc(`/leave`, LeaveLobby)
+	http.HandleFunc(`/settings`, SettingsHandler)
+	http.HandleFunc(`/history`, HistoryHandler)
+	http.HandleFunc(`/connect`, SignalingServer)
+	http.HandleFunc(`/metrics`, MetricsHandler)
+	http.HandleFunc(`/timelapse`, TimelapseHandler)
+	http.HandleFunc(`/signaling.schema.json`, SchemaHandler)
+	var e error
+	if TURN.PublicIP != `` {
+		if turnServer, e = relay.New(TURN); e != nil {
+			log.Fatal(e)
+		}
+		defer turnServer.Close()
+	}
+	if api, e = ICE.api(); e != nil {
+		log.Fatal(e)
+	}
+	if e := os.MkdirAll(RECORDINGS.Directory, 0750); e != nil {
+		log.Fatal(e)
+	}
+	record.Prune(RECORDINGS) //the limits may have changed since the server last ran
 	log.Println(`Palette Web Server Initialized`)
 	log.Fatal(http.ListenAndServeTLS(`:443`, `server.crt`, `server.key`, nil))
 }
@@ -73,9 +122,19 @@ func ReconnectHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	w.WriteHeader(http.StatusAccepted)
-	usr := lobby.GetUser(username)
-	usr.SetTimeDisconnect(user.NIL_TIME) //disable data deletion timer for this user
+	usr, position := lobby.GetUser(username), 0
+	if usr == nil { //the user may still be waiting for a slot
+		usr, position = lobby.Waiting(username)
+	}
+	if usr == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted) //the data deletion timer of the user stops once their new session is established, see `Session`
+	if position > 0 {
+		fmt.Fprintf(w, `You have been reconnected to '%v' as '%v'. You are #%v in the queue`, lobby.Name(), username, position)
+		return
+	}
 	fmt.Fprintf(w, `You have been reconnected to '%v' as '%v'`, lobby.Name(), username)
 }
 
@@ -90,24 +149,51 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	password := strings.TrimSpace(r.FormValue(`password`))
 	username := strings.TrimSpace(r.FormValue(`username`))
 	createLobby, _ := strconv.ParseBool(r.FormValue(`create`))
+	settings := lobby.DefaultSettings()
+	if r.FormValue(`capacity`) != `` { //the host may override the default capacity
+		n, e := strconv.Atoi(r.FormValue(`capacity`))
+		if e != nil {
+			http.Error(w, `capacity must be a number`, http.StatusBadRequest)
+			return
+		}
+		settings.Capacity = n
+		if e := settings.Validate(); e != nil {
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 	for _, parameter := range []string{lobbyName, password, username} {
 		if parameter == `` {
 			http.Error(w, `one or more required parameters were empty`, http.StatusBadRequest)
 			return
 		}
 	}
-	if username == `Palette` {
+	if username == user.SERVER_NAME {
 		http.Error(w, `Invalid Username. This name is reserved.`, http.StatusConflict)
 		return
 	}
+	if filter.Default.MatchesName(username) { //the custom terms of a lobby are checked once it is known
+		http.Error(w, `Invalid Username. This name contains a filtered word.`, http.StatusBadRequest)
+		return
+	}
 	//perform request operation
-	existingLobby := manager.GetLobby(lobbyName)
+	position := 0 //position in the waiting queue if the lobby is full
+	newUser := user.New(username)
+	newUser.SetTimeDisconnect(time.Now()) //the user's data is deleted unless their first session is established within the lobby's timeout
+	existingLobby := manager.FindLobby(lobbyName)
 	if createLobby { //making a lobby
 		if existingLobby != nil { //lobby already exists
 			w.WriteHeader(http.StatusConflict)
 			return
 		}
-		manager.AddLobby(lobby.New(lobbyName, password, MAX_USER_TIMEOUT, user.New(username)))
+		existingLobby = lobby.New(lobbyName, password, settings, MAX_USER_TIMEOUT, MAX_CHAT_HISTORY, newUser)
+		existingLobby.SetLimits(RATE_LIMITS)
+		existingLobby.OnRecord(startRecording)
+		if e := manager.AddLobby(existingLobby); e != nil { //lobby was created by someone else in the meantime
+			existingLobby.Close()
+			http.Error(w, e.Error(), http.StatusConflict)
+			return
+		}
 	} else { //joining a lobby
 		if existingLobby == nil { //lobby does not exist
 			w.WriteHeader(http.StatusNotFound)
@@ -117,16 +203,26 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		user := user.New(username)
-		existingLobby.AddUser(user)
-		username = user.Name()
+		if existingLobby.FilteredName(username) {
+			http.Error(w, `Invalid Username. This name contains a filtered word.`, http.StatusBadRequest)
+			return
+		}
+		if e := existingLobby.AddUser(newUser); e != nil { //lobby is shutting down
+			http.Error(w, e.Error(), http.StatusGone)
+			return
+		}
+		username = newUser.Name()
+		_, position = existingLobby.Waiting(username)
 	}
 	//save valid session to cookies
 	session, _ := store.Get(r, key)
-	session.Values[`lobby`] = lobbyName
+	session.Values[`lobby`] = existingLobby.ID() //the name of a lobby can change, its ID cannot
 	session.Values[`username`] = username
 	store.Save(r, w, session)
 	w.WriteHeader(http.StatusAccepted)
+	if position > 0 {
+		fmt.Fprintf(w, `'%v' is full. You are #%v in the queue`, lobbyName, position)
+	}
 }
 
 //LeaveLobby handles a deliberate request for a user to leave a lobby and have their data deleted
@@ -142,3 +238,74 @@ func LeaveLobby(w http.ResponseWriter, r *http.Request) {
 	session.Options.MaxAge = -1 //delete cookie from user
 	store.Save(r, w, session)   //delete cookie from valid cookies
 }
+
+//SettingsHandler responds with the settings of a user's lobby. Given a `POST` request with a partial JSON body
+//such as `{"rounds": 5}`, the settings are first updated on behalf of the user
+func SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	_, lobby, username := ParseSession(w, r)
+	if lobby == nil {
+		return
+	}
+	if r.Method == http.MethodPost {
+		update, e := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<12))
+		if e != nil {
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			return
+		}
+		if e := lobby.UpdateSettings(username, update); e != nil {
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set(`Content-Type`, `application/json`)
+	json.NewEncoder(w).Encode(lobby.Settings())
+}
+
+//HistoryHandler responds with a page of the chat history of a user's lobby given the optional
+//query parameters `before` and `limit`, see `lobby.Page`
+func HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	_, lobby, username := ParseSession(w, r)
+	if lobby == nil {
+		return
+	}
+	if lobby.GetUser(username) == nil { //users waiting for a slot have not joined the conversation yet
+		http.Error(w, `you have not joined this lobby`, http.StatusForbidden)
+		return
+	}
+	before, _ := strconv.Atoi(r.URL.Query().Get(`before`)) //invalid values are treated as 0, ie. the most recent page
+	limit, _ := strconv.Atoi(r.URL.Query().Get(`limit`))
+	w.Header().Set(`Content-Type`, `application/json`)
+	json.NewEncoder(w).Encode(lobby.History(before, limit))
+}
+
+//TimelapseHandler responds with an animated GIF of the whiteboard of the user's lobby as it was drawn, as a download
+func TimelapseHandler(w http.ResponseWriter, r *http.Request) {
+	_, lobby, username := ParseSession(w, r)
+	if lobby == nil {
+		return
+	}
+	if lobby.GetUser(username) == nil { //users waiting for a slot have not seen the whiteboard yet
+		http.Error(w, `you have not joined this lobby`, http.StatusForbidden)
+		return
+	}
+	gif, e := renderTimelapse(lobby)
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(`Content-Type`, `image/gif`)
+	w.Header().Set(`Content-Disposition`, fmt.Sprintf(`attachment; filename="timelapse-%v.gif"`, lobby.ID()))
+	w.Write(gif)
+}
+
+//SchemaHandler responds with the JSON Schema of the signaling protocol, see `signaling.SCHEMA`
+func SchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(`Content-Type`, `application/schema+json`)
+	w.Write(signaling.SCHEMA)
+}
+
+//MetricsHandler responds with the counters of the outbound queues of every user connected to the server, see `user.QueueMetrics`
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(`Content-Type`, `application/json`)
+	json.NewEncoder(w).Encode(user.Metrics())
+}
@@ -2,9 +2,12 @@
 package main
 
 import (
+	"Palette/lobby/user"
+	"Palette/signaling"
 	"encoding/json"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
@@ -15,98 +18,110 @@ var (
 		ReadBufferSize:  512,
 		WriteBufferSize: 512,
 		CheckOrigin: func(r *http.Request) bool {
-			_, lobby, _ := ParseSession(nil, r)
-			return lobby != nil //if the websocket connection is from a valid user in a lobby
+			session, e := store.Get(r, key)
+			return e == nil && session.Values[`lobby`] != nil //if the websocket connection is from a user that joined a lobby, see `SignalingServer()`
 		},
 	}
-	config = webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{{URLs: []string{`stun:stun.l.google.com:19302`}}},
-	}
+	api = webrtc.NewAPI() //WebRTC API with the settings of `ICE`, created by `main()`
 )
 
-//SignalingSocket is a thread safe WebSocket used only for establishing WebRTC connections
+/*
+	SignalingSocket is a thread safe WebSocket used only for establishing WebRTC connections, which speaks the
+	signaling protocol declared by the `signaling` package. Every message the server sends is given the next ID of the
+	socket so that the client can respond to it, ie. answer an offer.
+*/
 type SignalingSocket struct {
 	*websocket.Conn
+	lastID uint64 //ID of the last message sent
 	sync.Mutex
 }
 
-//SendSignal is a thread safe wrapper for the `websocket.WriteJSON()` function that only sends the JSON form of a `Signal` struct
-func (signaler *SignalingSocket) SendSignal(s Signal) error {
+//newSignalingSocket is the constructor for a signaling socket. Reads fail once neither a message nor a pong has
+//arrived for `HEARTBEAT_TIMEOUT`, see `Ping()`
+func newSignalingSocket(ws *websocket.Conn) *SignalingSocket {
+	ws.SetReadDeadline(time.Now().Add(HEARTBEAT_TIMEOUT))
+	ws.SetPongHandler(func(string) error { return ws.SetReadDeadline(time.Now().Add(HEARTBEAT_TIMEOUT)) })
+	return &SignalingSocket{Conn: ws}
+}
+
+//Ping sends a ping to the client, which browsers answer on their own
+func (signaler *SignalingSocket) Ping() error {
 	signaler.Lock()
 	defer signaler.Unlock()
-	return signaler.WriteJSON(s)
+	return signaler.WriteControl(websocket.PingMessage, nil, time.Now().Add(WATERMARKS.Stall))
 }
 
-//Signals to be written on a SignalingSocket in order to establish WebRTC connections
-type Signal struct {
-	Event string `json:"event"`
-	Data  string `json:"data"`
+//Send is a thread safe wrapper for the `websocket.WriteJSON()` function that sends a message of the signaling protocol
+//with the JSON of `data`, in response to the message with the ID `re` unless it is 0. Returns the ID of the message.
+//A write that takes longer than `WATERMARKS.Stall` fails and breaks the socket, as the client is stuck
+func (signaler *SignalingSocket) Send(kind string, re uint64, data interface{}) (uint64, error) {
+	signaler.Lock()
+	defer signaler.Unlock()
+	signaler.lastID++
+	signaler.SetWriteDeadline(time.Now().Add(WATERMARKS.Stall))
+	return signaler.lastID, signaler.WriteJSON(signaling.New(kind, signaler.lastID, re, data))
 }
 
-func SignalingServer(w http.ResponseWriter, r *http.Request) {
-	//create a thread safe websocket for signaling with JavaScript
-	ws, e := wsUpgrader.Upgrade(w, r, nil)
-	if e != nil {
-		http.Error(w, e.Error(), http.StatusBadRequest)
+//Fail sends an error frame to the client in response to the message with the ID `re` unless it is 0. If the error is
+//fatal, the socket is then closed with the code of the error as the reason
+func (signaler *SignalingSocket) Fail(re uint64, failure *signaling.Error) {
+	if _, e := signaler.Send(signaling.ERROR, re, failure); e != nil || !failure.Fatal() {
+		return
 	}
-	signaler := SignalingSocket{ws, sync.Mutex{}}
-	defer signaler.Close()
+	code := websocket.ClosePolicyViolation //the client broke the protocol
+	switch failure.Code {
+	case signaling.INTERNAL, signaling.CONNECTION_FAILED:
+		code = websocket.CloseInternalServerErr
+	case signaling.NOT_A_MEMBER:
+		code = signaling.CLOSE_NOT_A_MEMBER
+	}
+	signaler.Lock()
+	signaler.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, string(failure.Code)), time.Now().Add(WATERMARKS.Stall))
+	signaler.Unlock()
+	signaler.Close()
+}
 
-	//create the WebRTC peer connection that will broadcast lobby events, chat and whiteboard data
-	peer, e := webrtc.NewPeerConnection(config)
+//Receive reads the next message of the client. Returns a `signaling.Error` if the message is malformed,
+//any other error means that the socket is closed
+func (signaler *SignalingSocket) Receive() (signaling.Message, error) {
+	msg := signaling.Message{}
+	_, data, e := signaler.ReadMessage()
 	if e != nil {
-		return
+		return msg, e
 	}
-	notTrue := false //create data channel to stream whiteboard data to users in the lobby
-	channel, e := peer.CreateDataChannel(`whiteboard`, &webrtc.DataChannelInit{Ordered: &notTrue})
-	if e != nil {
-		return
+	signaler.SetReadDeadline(time.Now().Add(HEARTBEAT_TIMEOUT))
+	if e := json.Unmarshal(data, &msg); e != nil {
+		return signaling.Message{}, signaling.Errorf(signaling.BAD_REQUEST, `invalid message: %v`, e)
 	}
-	channel.OnMessage(func(msg webrtc.DataChannelMessage) {}) //todo: parse data and forward to lobby channel
-
-	peer.OnICECandidate(func(ice *webrtc.ICECandidate) {
-		if ice == nil {
-			return
-		}
-		iceJS, _ := json.Marshal(ice.ToJSON()) //error is ignored as the struct is generated by WebRTC
-		if e := signaler.SendSignal(Signal{`ice`, string(iceJS)}); e != nil {
-			signaler.Close()
-		}
-	})
+	if msg.Type == `` {
+		return msg, signaling.Errorf(signaling.BAD_REQUEST, `invalid message: missing type`)
+	}
+	return msg, nil
+}
 
-	offer, e := peer.CreateOffer(nil) //send offer to frontend
+//SignalingServer establishes the WebRTC connection of a user in a lobby and the DataChannels used to interact with the lobby,
+//over the signaling protocol served at `/signaling.schema.json`.
+//A user can connect again at any time, ie. after a network change, in which case the new session replaces the old one, see `Session`.
+//Users that are no longer in their lobby are told so over the socket, as browsers do not expose why a WebSocket could not connect
+func SignalingServer(w http.ResponseWriter, r *http.Request) {
+	//create a thread safe websocket for signaling with JavaScript
+	ws, e := wsUpgrader.Upgrade(w, r, nil)
 	if e != nil {
-		return
+		return //the upgrader has already responded with an error
 	}
-	if e := peer.SetLocalDescription(offer); e != nil {
-		return
+	signaler := newSignalingSocket(ws)
+	_, lobby, username := ParseSession(nil, r)
+	var usr *user.User
+	if lobby != nil {
+		if usr = lobby.GetUser(username); usr == nil { //users waiting for a slot still connect to receive updates
+			usr, _ = lobby.Waiting(username)
+		}
 	}
-	offerJS, _ := json.Marshal(offer)
-	if e = signaler.SendSignal(Signal{`offer`, string(offerJS)}); e != nil {
+	if usr == nil {
+		signaler.Fail(0, signaling.Errorf(signaling.NOT_A_MEMBER, `user not found`))
 		return
 	}
-	signal := Signal{}
-	for {
-		if e := signaler.ReadJSON(&signal); e != nil {
-			return
-		}
-		switch signal.Event {
-		case `ice`:
-			candidate := webrtc.ICECandidateInit{}
-			if e := json.Unmarshal([]byte(signal.Data), &candidate); e != nil {
-				return
-			}
-			if e := peer.AddICECandidate(candidate); e != nil {
-				return
-			}
-		case `answer`:
-			answer := webrtc.SessionDescription{}
-			if e := json.Unmarshal([]byte(signal.Data), &answer); e != nil {
-				return
-			}
-			if e := peer.SetRemoteDescription(answer); e != nil {
-				return
-			}
-		}
-	}
+	session := newSession(lobby, usr, signaler)
+	defer session.Close()
+	session.Run()
 }
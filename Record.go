@@ -0,0 +1,55 @@
+// Palette © Albert Bregonia 2021
+package main
+
+import (
+	"Palette/lobby"
+	"Palette/record"
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+//recordings are the recordings in progress of every lobby that is being recorded, see `startRecording()`
+var recordings = struct {
+	lobbies map[*lobby.Lobby]*record.Recording
+	sync.Mutex
+}{lobbies: make(map[*lobby.Lobby]*record.Recording)}
+
+//lobbyRecording is the recorder of a lobby, it stops receiving voice once it is closed
+type lobbyRecording struct {
+	*record.Recording
+	lobby *lobby.Lobby
+}
+
+//Close stops the recording of a lobby
+func (recording lobbyRecording) Close() error {
+	recordings.Lock()
+	if recordings.lobbies[recording.lobby] == recording.Recording {
+		delete(recordings.lobbies, recording.lobby)
+	}
+	recordings.Unlock()
+	return recording.Recording.Close()
+}
+
+//startRecording starts recording a lobby to a new directory of `RECORDINGS` once the host enables recording in its
+//settings, see `lobby.OnRecord()`. The voice chat of the lobby is recorded by `recordVoice()`
+func startRecording(l *lobby.Lobby) (lobby.Recorder, error) {
+	recording, e := record.Start(RECORDINGS, l.ID())
+	if e != nil {
+		return nil, e
+	}
+	recordings.Lock()
+	recordings.lobbies[l] = recording
+	recordings.Unlock()
+	return lobbyRecording{recording, l}, nil
+}
+
+//recordVoice writes a packet of the voice of a user to the recording of a lobby if it is being recorded
+func recordVoice(l *lobby.Lobby, name string, packet *rtp.Packet) {
+	recordings.Lock()
+	recording := recordings.lobbies[l]
+	recordings.Unlock()
+	if recording != nil {
+		recording.Voice(name, packet)
+	}
+}
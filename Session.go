@@ -0,0 +1,412 @@
+// Palette © Albert Bregonia 2021
+package main
+
+import (
+	"Palette/lobby"
+	"Palette/lobby/user"
+	"Palette/signaling"
+	"Palette/voice"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+//MAX_ICE_RESTARTS is the number of times in a row the server restarts ICE after a connection has failed before falling back to WebSockets
+const MAX_ICE_RESTARTS = 3
+
+//activeSessions is the current signaling session of every connected user
+var activeSessions = struct {
+	users map[*user.User]*Session
+	sync.Mutex
+}{users: make(map[*user.User]*Session)}
+
+/*
+	Session is a single signaling connection of a user and the WebRTC connection established over it.
+
+	The channels of a session are only given to the user once every one of them has opened, at which point they
+	replace the channels of the user's previous session at once and the previous session is closed. This means a user
+	can open a new signaling socket at any time, ie. after a network change, and the lobby keeps sending to the old
+	channels until the new ones are ready. The whiteboard and chat of the user are then redrawn from the lobby.
+
+	If ICE fails after the connection was established, the server restarts ICE and sends a new offer over the same
+	socket, up to `MAX_ICE_RESTARTS` times in a row. If no connection is established within `ICE_TIMEOUT` or ICE keeps
+	failing, the session falls back to `SocketChannel`s if the client supports it.
+
+	The current session of a user also decides whether the user is connected. Users start out disconnected when they
+	log in so that their data is deleted if no session of theirs is ever used. They are marked disconnected once the
+	heartbeat of their current session goes unanswered, its peer connection goes down or it is closed, and are marked
+	connected again as soon as it recovers or a new session replaces it, see `heartbeat()`.
+*/
+type Session struct {
+	lobby        *lobby.Lobby
+	usr          *user.User
+	signaler     *SignalingSocket
+	peer         *webrtc.PeerConnection
+	handlers     map[string]func([]byte) //handlers of the messages of every channel by label
+	pending      map[string]user.Channel //channels that have opened but are not in use yet
+	queues       []*user.Queue           //outbound queues of every channel of this session, see `queue()`
+	active       bool                    //whether the channels of this session are in use by the user
+	restarts     int                     //number of ICE restarts since the connection last failed
+	reoffer      *bool                   //offer to send once the client has answered the current one, `true` if it restarts ICE
+	offerID      uint64                  //ID of the current offer, which the answer must respond to
+	fellBack     bool                    //whether the channels of this session are sent over the socket, see `fallBack()`
+	capabilities []string                //capabilities supported by both the client and server, see `signaling.Hello`
+	events       user.Channel            //`events` channel of this session once it is in use, see `heartbeat()`
+	lastPong     time.Time               //time the client last answered a ping over `events`
+	stop         chan struct{}           //closed once the session is closed
+	voice        *voice.Member           //`nil` if the user has not joined the voice chat of the lobby
+	timer        *time.Timer             //falls back to WebSockets once `ICE_TIMEOUT` has passed without a connection
+	fallback     sync.Once
+	sync.Mutex
+}
+
+//newSession is the constructor for the signaling session of a user over a socket
+func newSession(lobby *lobby.Lobby, usr *user.User, signaler *SignalingSocket) *Session {
+	session := &Session{
+		lobby:    lobby,
+		usr:      usr,
+		signaler: signaler,
+		pending:  make(map[string]user.Channel),
+		stop:     make(chan struct{}),
+	}
+	session.handlers = map[string]func([]byte){ //the sender is the user of this session, never what the client claims
+		user.EVENTS:   session.control,
+		user.CHAT:     func(data []byte) { lobby.Receive(usr, data) },
+		user.STROKES:  func(data []byte) { lobby.Draw(usr, data) }, //data over the drawing budget or from users that cannot draw is dropped
+		user.PRESENCE: func(data []byte) { lobby.Presence(usr, data) },
+	}
+	return session
+}
+
+//Run performs the handshake of a session, then creates its WebRTC connection and handles the messages of the client
+//until the socket is closed. Malformed or unexpected messages are answered with an error frame, see `signaling.Error`
+func (session *Session) Run() {
+	go session.heartbeat()
+	hello, e := session.signaler.Receive()
+	if e == nil {
+		e = session.handshake(hello)
+	}
+	if e != nil {
+		session.fail(hello.ID, e)
+		return
+	}
+	for {
+		msg, e := session.signaler.Receive()
+		if e == nil {
+			e = session.handle(msg)
+		}
+		if e != nil && !session.fail(msg.ID, e) {
+			return
+		}
+	}
+}
+
+//handshake accepts the `hello` of the client, creates the WebRTC connection of a session and sends the first offer
+//along with the ICE configuration the client must use before it answers. Internal use only!
+func (session *Session) handshake(msg signaling.Message) error {
+	if msg.Type != signaling.HELLO {
+		return signaling.Errorf(signaling.HANDSHAKE_REQUIRED, `the first message must be '%v', not '%v'`, signaling.HELLO, msg.Type)
+	}
+	hello := signaling.Hello{}
+	if e := msg.Decode(&hello); e != nil {
+		return signaling.Errorf(signaling.HANDSHAKE_REQUIRED, `invalid '%v': %v`, signaling.HELLO, e)
+	}
+	capabilities, e := signaling.Negotiate(hello)
+	if e != nil {
+		return e
+	}
+	session.capabilities = capabilities
+	peer, e := api.NewPeerConnection(ICE.server(session.usr.Name()))
+	if e != nil {
+		return signaling.Errorf(signaling.INTERNAL, `unable to create peer connection: %v`, e)
+	}
+	session.peer = peer
+	for _, spec := range user.CHANNELS { //create every channel of the catalogue with its delivery guarantees
+		spec, ordered := spec, spec.Ordered
+		options := &webrtc.DataChannelInit{Ordered: &ordered}
+		if !spec.Reliable() {
+			maxRetransmits := uint16(spec.MaxRetransmits)
+			options.MaxRetransmits = &maxRetransmits
+		}
+		channel, e := peer.CreateDataChannel(spec.Label, options)
+		if e != nil {
+			return signaling.Errorf(signaling.INTERNAL, `unable to create channel '%v': %v`, spec.Label, e)
+		}
+		if handler := session.handlers[spec.Label]; handler != nil {
+			channel.OnMessage(func(msg webrtc.DataChannelMessage) { handler(msg.Data) })
+		}
+		channel.OnOpen(func() { session.open(spec, channel) })
+	}
+	peer.OnICECandidate(func(ice *webrtc.ICECandidate) {
+		if ice == nil {
+			return
+		}
+		if _, e := session.signaler.Send(signaling.ICE, 0, ice.ToJSON()); e != nil {
+			session.signaler.Close()
+		}
+	})
+	peer.OnICEConnectionStateChange(session.iceStateChanged)
+	peer.OnConnectionStateChange(session.peerStateChanged)
+	if session.supports(signaling.CAPABILITY_VOICE) {
+		if e := session.joinVoice(); e != nil {
+			return signaling.Errorf(signaling.INTERNAL, `unable to join voice chat: %v`, e)
+		}
+	}
+	welcome := signaling.Welcome{Version: signaling.VERSION, Capabilities: capabilities, ICE: ICE.client(session.usr.Name())}
+	if _, e := session.signaler.Send(signaling.WELCOME, msg.ID, welcome); e != nil {
+		return e
+	}
+	session.Lock() //ICE state changes stop the timer under the lock
+	session.timer = time.AfterFunc(ICE_TIMEOUT, session.fallBack)
+	session.Unlock()
+	return session.offer(false)
+}
+
+//handle handles a message of the client after the handshake. Returns a `signaling.Error` if the message is invalid,
+//any other error means that the socket is closed. Internal use only!
+func (session *Session) handle(msg signaling.Message) error {
+	switch msg.Type {
+	case signaling.ICE:
+		candidate := webrtc.ICECandidateInit{}
+		if e := msg.Decode(&candidate); e != nil {
+			return e
+		}
+		if e := session.peer.AddICECandidate(candidate); e != nil {
+			return signaling.Errorf(signaling.NEGOTIATION_FAILED, `invalid ICE candidate: %v`, e)
+		}
+	case signaling.ANSWER:
+		answer := webrtc.SessionDescription{}
+		if e := msg.Decode(&answer); e != nil {
+			return e
+		}
+		session.Lock()
+		current := session.offerID
+		session.Unlock()
+		if msg.Re != current || session.peer.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+			return signaling.Errorf(signaling.INVALID_STATE, `the answer does not respond to the current offer %v`, current)
+		}
+		if e := session.peer.SetRemoteDescription(answer); e != nil {
+			return signaling.Errorf(signaling.NEGOTIATION_FAILED, `invalid answer: %v`, e)
+		}
+		return session.answered()
+	case signaling.RESTART: //the client noticed that the connection failed before the server did
+		return session.offer(true)
+	case signaling.RENEGOTIATE: //the client added or removed a track, ie. turned on their microphone
+		return session.offer(false)
+	case signaling.CHANNEL: //messages of a channel sent over the socket after falling back, see `SocketChannel`
+		session.Lock()
+		fellBack := session.fellBack
+		session.Unlock()
+		if !fellBack {
+			return signaling.Errorf(signaling.INVALID_STATE, `channels are only sent over the socket after falling back`)
+		}
+		message := signaling.ChannelMessage{}
+		if e := msg.Decode(&message); e != nil {
+			return e
+		}
+		data := []byte(message.Data)
+		if message.Binary {
+			var e error
+			if data, e = base64.StdEncoding.DecodeString(message.Data); e != nil {
+				return signaling.Errorf(signaling.BAD_REQUEST, `invalid binary data: %v`, e)
+			}
+		}
+		handler := session.handlers[message.Channel]
+		if handler == nil {
+			return signaling.Errorf(signaling.BAD_REQUEST, `unknown channel '%v'`, message.Channel)
+		}
+		handler(data)
+	case signaling.HELLO:
+		return signaling.Errorf(signaling.INVALID_STATE, `the handshake is already complete`)
+	default:
+		return signaling.Errorf(signaling.UNKNOWN_TYPE, `unknown message type '%v'`, msg.Type)
+	}
+	return nil
+}
+
+//fail reports an error to the client in response to the message with the ID `re`. Returns false if the session ends,
+//that is if the error is fatal or is not an error of the protocol, ie. the socket was closed. Internal use only!
+func (session *Session) fail(re uint64, e error) bool {
+	failure, ok := e.(*signaling.Error)
+	if !ok {
+		return false
+	}
+	session.signaler.Fail(re, failure)
+	return !failure.Fatal()
+}
+
+//supports reports whether both the client and server of a session support a capability. Internal use only!
+func (session *Session) supports(capability string) bool {
+	for _, supported := range session.capabilities {
+		if supported == capability {
+			return true
+		}
+	}
+	return false
+}
+
+//offer sends an offer to the client, with new ICE credentials if `restart` is true. If the client has not answered
+//the previous offer yet, the offer is sent once it has, see `answered()`. Returns a `signaling.Error` with the code
+//`INVALID_STATE` if the session has fallen back, as its peer connection is closed. Internal use only!
+func (session *Session) offer(restart bool) error {
+	session.Lock()
+	defer session.Unlock()
+	if session.fellBack {
+		return signaling.Errorf(signaling.INVALID_STATE, `there is no WebRTC connection to negotiate after falling back`)
+	}
+	if session.peer.SignalingState() != webrtc.SignalingStateStable {
+		restart = restart || (session.reoffer != nil && *session.reoffer)
+		session.reoffer = &restart
+		return nil
+	}
+	offer, e := session.peer.CreateOffer(&webrtc.OfferOptions{ICERestart: restart})
+	if e != nil {
+		return signaling.Errorf(signaling.INTERNAL, `unable to offer: %v`, e)
+	}
+	if e := session.peer.SetLocalDescription(offer); e != nil {
+		return signaling.Errorf(signaling.INTERNAL, `unable to offer: %v`, e)
+	}
+	session.offerID, e = session.signaler.Send(signaling.OFFER, 0, offer)
+	return e
+}
+
+//answered sends the offer that was held back while the client was answering the previous one. Internal use only!
+func (session *Session) answered() error {
+	session.Lock()
+	reoffer := session.reoffer
+	session.reoffer = nil
+	session.Unlock()
+	if reoffer == nil {
+		return nil
+	}
+	return session.offer(*reoffer)
+}
+
+//iceStateChanged restarts ICE or falls back to WebSockets when the connection of a session fails. Internal use only!
+func (session *Session) iceStateChanged(state webrtc.ICEConnectionState) {
+	switch state {
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+		session.Lock()
+		session.restarts = 0
+		session.timer.Stop()
+		session.Unlock()
+	case webrtc.ICEConnectionStateFailed:
+		session.Lock()
+		restart := session.restarts < MAX_ICE_RESTARTS
+		if restart {
+			session.restarts++
+			session.timer.Reset(ICE_TIMEOUT)
+		}
+		session.Unlock()
+		if restart {
+			go session.offer(true) //the peer connection cannot be renegotiated from its own callback
+		} else {
+			go session.fallBack()
+		}
+	}
+}
+
+//open is called once a channel of a session has opened. Once every channel of the catalogue has opened,
+//they replace the channels of the user. Internal use only!
+func (session *Session) open(spec user.Spec, channel user.Channel) {
+	session.Lock()
+	session.pending[spec.Label] = session.queue(spec, channel)
+	ready := len(session.pending) == len(user.CHANNELS) && !session.active
+	session.active = session.active || ready
+	channels := make(map[string]user.Channel, len(session.pending))
+	for label, channel := range session.pending {
+		channels[label] = channel
+	}
+	session.Unlock()
+	if ready {
+		session.activate(channels)
+	}
+}
+
+/*
+	fallBack switches a session to `SocketChannel`s, so that users behind networks that block WebRTC entirely can still
+	chat and see the whiteboard. The client is told which channels to expect with `signaling.Fallback` and the peer
+	connection is closed. The lobby does not notice the switch as it only ever sends to a user's channels, see
+	`user.Channel`. Clients that cannot fall back are disconnected instead. Internal use only!
+*/
+func (session *Session) fallBack() {
+	session.fallback.Do(func() {
+		if !session.supports(signaling.CAPABILITY_FALLBACK) {
+			session.signaler.Fail(0, signaling.Errorf(signaling.CONNECTION_FAILED, `unable to establish a WebRTC connection`))
+			return
+		}
+		channels := make(map[string]user.Channel, len(user.CHANNELS))
+		labels := make([]string, 0, len(user.CHANNELS))
+		session.Lock()
+		session.fellBack = true
+		for _, spec := range user.CHANNELS {
+			channels[spec.Label] = session.queue(spec, &SocketChannel{spec.Label, session.signaler})
+			labels = append(labels, spec.Label)
+		}
+		session.Unlock()
+		session.signaler.Send(signaling.FALLBACK, 0, signaling.Fallback{Channels: labels})
+		session.leaveVoice() //voice is only available over WebRTC
+		session.peer.Close()
+		session.activate(channels)
+	})
+}
+
+//queue wraps a channel of a session in an outbound queue, so that the lobby never waits for a slow client.
+//Clients that are stuck are disconnected and connect again with a new session. The session must be locked. Internal use only!
+func (session *Session) queue(spec user.Spec, channel user.Channel) *user.Queue {
+	queue := user.NewQueue(channel, spec.Essential, WATERMARKS, func() { session.signaler.Close() })
+	session.queues = append(session.queues, queue)
+	return queue
+}
+
+//activate replaces the channels of the user and the user's previous session with this session,
+//then redraws the chat and whiteboard of the user. Internal use only!
+func (session *Session) activate(channels map[string]user.Channel) {
+	session.Lock()
+	session.active = true
+	session.events, session.lastPong = channels[user.EVENTS], time.Now()
+	session.usr.SwapChannels(channels)
+	session.Unlock()
+	activeSessions.Lock()
+	previous := activeSessions.users[session.usr]
+	activeSessions.users[session.usr] = session
+	activeSessions.Unlock()
+	if previous != nil && previous != session {
+		previous.signaler.Close() //the previous session cleans up once its socket is closed
+	}
+	session.alive(true)                          //the user has resumed
+	session.lobby.SendHistory(session.usr, 0, 0) //catch the user up on the conversation
+	session.lobby.SendWhiteboard(session.usr)
+}
+
+//Close closes the socket and peer connection of a session. If the session is the current session of its user,
+//the user's channels are removed and they are marked disconnected until they connect again
+func (session *Session) Close() {
+	session.fallback.Do(func() {}) //it is too late to fall back
+	close(session.stop)
+	session.Lock()
+	if session.timer != nil {
+		session.timer.Stop()
+	}
+	for _, queue := range session.queues {
+		queue.Close()
+	}
+	session.Unlock()
+	session.signaler.Close()
+	session.leaveVoice()
+	if session.peer != nil {
+		session.peer.Close()
+	}
+	activeSessions.Lock()
+	current := activeSessions.users[session.usr] == session
+	if current {
+		delete(activeSessions.users, session.usr)
+	}
+	activeSessions.Unlock()
+	if current {
+		session.usr.SwapChannels(nil)
+		session.usr.SetTimeDisconnect(time.Now()) //the user's data is deleted unless they resume within the lobby's timeout
+	}
+}
@@ -0,0 +1,67 @@
+// Palette © Albert Bregonia 2021
+package main
+
+import (
+	"Palette/lobby"
+	"Palette/timelapse"
+	"bytes"
+	"sync"
+	"time"
+)
+
+//timelapses are the time-lapses last rendered of every lobby, see `renderTimelapse()`
+var timelapses = struct {
+	lobbies map[*lobby.Lobby]*cachedTimelapse
+	sync.Mutex
+}{lobbies: make(map[*lobby.Lobby]*cachedTimelapse)}
+
+//cachedTimelapse is the time-lapse last rendered of a lobby along with the whiteboard it shows
+type cachedTimelapse struct {
+	gif         []byte
+	rendered    time.Time //time the GIF was rendered
+	first, last time.Time //time of the first and last stroke of the whiteboard
+	strokes     int       //number of strokes of the whiteboard
+	sync.Mutex            //held while rendering, so that the time-lapse of a lobby is only rendered once at a time
+}
+
+//renderTimelapse returns an animated GIF of the whiteboard of a lobby, see `timelapse.Render()`. As rendering a large
+//whiteboard is expensive and any member can request it, a lobby's time-lapse is only rendered again once its
+//whiteboard has changed and `TIMELAPSE_INTERVAL` has passed, until then the previous GIF is returned.
+//Returns an error if the GIF cannot be rendered
+func renderTimelapse(l *lobby.Lobby) ([]byte, error) {
+	timelapses.Lock()
+	cached := timelapses.lobbies[l]
+	if cached == nil {
+		cached = &cachedTimelapse{}
+		timelapses.lobbies[l] = cached
+		go func() { //the time-lapse is forgotten once the lobby shuts down
+			<-l.Context().Done()
+			timelapses.Lock()
+			delete(timelapses.lobbies, l)
+			timelapses.Unlock()
+		}()
+	}
+	timelapses.Unlock()
+	cached.Lock()
+	defer cached.Unlock()
+	lobbyStrokes := l.Strokes()
+	first, last := time.Time{}, time.Time{}
+	if len(lobbyStrokes) > 0 {
+		first, last = lobbyStrokes[0].Time, lobbyStrokes[len(lobbyStrokes)-1].Time
+	}
+	changed := len(lobbyStrokes) != cached.strokes || !first.Equal(cached.first) || !last.Equal(cached.last)
+	if cached.gif != nil && (!changed || time.Since(cached.rendered) < TIMELAPSE_INTERVAL) {
+		return cached.gif, nil
+	}
+	strokes := make([]timelapse.Stroke, len(lobbyStrokes))
+	for i, stroke := range lobbyStrokes {
+		strokes[i] = timelapse.Stroke{Time: stroke.Time, Data: stroke.Data}
+	}
+	buffer := &bytes.Buffer{}
+	if e := timelapse.Render(buffer, strokes, TIMELAPSE); e != nil {
+		return nil, e
+	}
+	cached.gif, cached.rendered = buffer.Bytes(), time.Now()
+	cached.first, cached.last, cached.strokes = first, last, len(lobbyStrokes)
+	return cached.gif, nil
+}
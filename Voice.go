@@ -0,0 +1,67 @@
+// Palette © Albert Bregonia 2021
+package main
+
+import (
+	"Palette/lobby"
+	"Palette/signaling"
+	"Palette/voice"
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+//voiceRooms are the voice chats of every lobby that has a member connected over WebRTC
+var voiceRooms = struct {
+	rooms map[*lobby.Lobby]*voice.Room
+	sync.Mutex
+}{rooms: make(map[*lobby.Lobby]*voice.Room)}
+
+//joinVoice adds the peer connection of a session to the voice chat of its lobby before it is first negotiated. Users
+//waiting for a slot do not join, they only hear the lobby once they connect again as a member. Whether a user can be
+//heard is decided by the lobby for every packet, see `lobby.Audible()`. Internal use only!
+func (session *Session) joinVoice() error {
+	if session.lobby.GetUser(session.usr.Name()) != session.usr {
+		return nil
+	}
+	voiceRooms.Lock()
+	defer voiceRooms.Unlock()
+	room := voiceRooms.rooms[session.lobby]
+	if room == nil {
+		room = voice.NewRoom()
+		room.OnPacket(func(name string, packet *rtp.Packet) { recordVoice(session.lobby, name, packet) })
+		voiceRooms.rooms[session.lobby] = room
+	}
+	member, e := room.Join(session.usr.Name(), session.peer,
+		func() bool { return session.lobby.Audible(session.usr) },
+		func() { //tracks of other members were added or removed
+			e := session.offer(false)
+			if failure, ok := e.(*signaling.Error); e != nil && !(ok && failure.Code == signaling.INVALID_STATE) { //the session may be falling back
+				session.signaler.Close()
+			}
+		},
+	)
+	if e != nil {
+		return e
+	}
+	session.Lock()
+	session.voice = member
+	session.Unlock()
+	return nil
+}
+
+//leaveVoice removes the peer connection of a session from the voice chat of its lobby. Internal use only!
+func (session *Session) leaveVoice() {
+	session.Lock()
+	member := session.voice
+	session.voice = nil
+	session.Unlock()
+	if member == nil {
+		return
+	}
+	voiceRooms.Lock()
+	defer voiceRooms.Unlock()
+	member.Leave()
+	if room := voiceRooms.rooms[session.lobby]; room != nil && room.Size() == 0 {
+		delete(voiceRooms.rooms, session.lobby)
+	}
+}
@@ -4,7 +4,9 @@ const loginDialog = document.getElementById(`login-dialog`),
       lobbyNameInput = document.getElementById(`lobby-name`),
       usernameInput = document.getElementById(`username`),
       passwordInput = document.getElementById(`password`),
-      mainUI = document.getElementById(`main-ui`);
+      mainUI = document.getElementById(`main-ui`),
+      chatLog = document.getElementById(`chat-log`),
+      chatInput = document.getElementById(`chat`);
 
 // user login and lobby registration
 
@@ -46,52 +48,235 @@ function disconnectHandler() {
 
 // set up connections
 
+//signaling protocol, see /signaling.schema.json for every message and its data
+const SIGNALING_VERSION = 1,
+      CAPABILITIES = [`voice`, `fallback`],
+      CLOSE_NOT_A_MEMBER = 4000, //the user is no longer in the lobby
+      MAX_RECONNECT_DELAY = 30000;
+
+let reconnectDelay = 1000; //doubles every time the socket closes before the server welcomed this client
+
 function WebRTCStartup() {
 
-    function formatSignal(event, data) {
-        return JSON.stringify({ 
-            event: event, 
-            data: JSON.stringify(data)
-        });
-    }
+    let lastID = 0;
+    //send sends a message of the signaling protocol, in response to the message with the ID `re` if it is given
+    const send = (type, data, re) => ws.send(JSON.stringify({type, id: ++lastID, re, data}));
 
     const ws = new WebSocket(`wss://${location.hostname}:${location.port}/connect`); //create a websocket for WebRTC signaling 
-    ws.onopen = () => console.log(`Connected`);
-    ws.onclose = ws.onerror = ({reason}) => alert(`Disconnected ${reason}`);
-    
-    const rtc = new RTCPeerConnection({iceServers: [{urls: `stun:stun.l.google.com:19302`}]}); //create a WebRTC instance
-    rtc.onicecandidate = ({candidate}) => candidate && ws.send(formatSignal(`ice`, candidate)); //if the ice candidate is not null, send it to the peer
-    rtc.oniceconnectionstatechange = () => rtc.iceConnectionState == `failed` && rtc.restartIce();
-    rtc.ondatachannel = ({channel}) => {
-        if(channel.label != `whiteboard`)
-            return;
-        whiteboardSetup();
-        rtc.whiteboard = channel;
-        rtc.whiteboard.onmessage = ({data}) => shareHandler(JSON.parse(data));
+    ws.onopen = () => console.log(`Connected`) || send(`hello`, {version: SIGNALING_VERSION, capabilities: CAPABILITIES});
+    ws.onclose = ({code, reason}) => { //the server keeps this user alive for a while, connect again with a new session
+        rtc.close();
+        if(code == 1008) //the server does not speak this protocol, connecting again will not help
+            return alert(`Unable to connect: ${reason}`);
+        if(code == CLOSE_NOT_A_MEMBER) //kicked, left or the lobby was deleted
+            return console.log(`Disconnected: no longer in the lobby`);
+        console.log(`Disconnected, reconnecting in ${reconnectDelay}ms...`);
+        setTimeout(WebRTCStartup, reconnectDelay);
+        reconnectDelay = Math.min(reconnectDelay * 2, MAX_RECONNECT_DELAY);
     };
+    
+    const rtc = new RTCPeerConnection(); //create a WebRTC instance, its ICE configuration is sent by the server before the offer
+    rtc.onicecandidate = ({candidate}) => candidate && send(`ice`, candidate); //if the ice candidate is not null, send it to the peer
+    rtc.oniceconnectionstatechange = () => rtc.iceConnectionState == `failed` && send(`restart`); //the server re-offers
+    rtc.ondatachannel = ({channel}) => channelSetup(rtc, channel);
+    rtc.ontrack = ({track, streams}) => speakerSetup(track, streams[0]); //voice of another user, the stream ID is their name
+    window.rtc = rtc;
+    window.ws = ws;
+    ws.signal = send;
 
     ws.onmessage = async ({data}) => { //signal handler
-        const signal = JSON.parse(data),
-              content = JSON.parse(signal.data);
-        switch(signal.event) {
+        const {type, id, re, data: payload} = JSON.parse(data);
+        switch(type) {
+            case `welcome`: //capabilities of this session and its ICE configuration, ie. credentials for the server's TURN relay
+                reconnectDelay = 1000;
+                rtc.setConfiguration({...rtc.getConfiguration(), ...payload.ice});
+                break;
             case `offer`:
-                console.log(`got offer!`, content);
-                await rtc.setRemoteDescription(content); //accept offer
+                console.log(`got offer!`, payload);
+                await rtc.setRemoteDescription(payload); //accept offer
+                publishVoice(rtc);
                 const answer = await rtc.createAnswer();
                 await rtc.setLocalDescription(answer);
-                ws.send(formatSignal(`answer`, answer)); //send answer
+                send(`answer`, answer, id); //send answer
                 console.log(`sent answer!`, answer);
                 break;
             case `ice`:
-                console.log(`got ice!`, content);
-                rtc.addIceCandidate(content); //add ice candidates
+                console.log(`got ice!`, payload);
+                rtc.addIceCandidate(payload); //add ice candidates
+                break;
+            case `fallback`: //WebRTC failed, the server sends every channel over this socket instead
+                console.log(`falling back to WebSocket channels`);
+                rtc.oniceconnectionstatechange = null;
+                rtc.close();
+                payload.channels.forEach(label => channelSetup(rtc, socketChannel(send, label)));
+                break;
+            case `message`: //a message of a channel sent over this socket
+                const channel = rtc[payload.channel];
+                channel && channel.onmessage({data: payload.binary ? Uint8Array.from(atob(payload.data), c => c.charCodeAt(0)).buffer : payload.data});
+                break;
+            case `error`:
+                console.error(`signaling error in response to ${re}:`, payload.code, payload.message);
                 break;
             default:
-                console.log(`Invalid message:`, content);
+                console.log(`Invalid message:`, type, payload);
         }
     };
 }
 
+//channelSetup handles the messages of a channel from the server, either a DataChannel or a `socketChannel()`
+function channelSetup(rtc, channel) {
+    switch(channel.label) {
+        case `events`:
+            rtc.events = channel;
+            rtc.events.onmessage = ({data}) => eventHandler(JSON.parse(data));
+            break;
+        case `strokes`:
+            whiteboard.brush || whiteboardSetup(); //keep the drawing when reconnecting
+            rtc.strokes = channel;
+            rtc.strokes.onmessage = ({data}) => shareHandler(JSON.parse(decode(data)));
+            break;
+        case `presence`: //cursors of other users, may arrive out of order or not at all
+            rtc.presence = channel;
+            rtc.presence.onmessage = ({data}) => console.debug(`presence`, decode(data));
+            break;
+        case `chat`:
+            rtc.chat = channel;
+            rtc.chat.onmessage = ({data}) => {
+                const msg = JSON.parse(data);
+                if(msg.history)
+                    msg.history.messages.forEach(chatLogger);
+                else if(msg.reactions)
+                    reactionLogger(msg.reactions);
+                else if(msg.deleted)
+                    deletionLogger(msg.deleted);
+                else
+                    chatLogger(msg);
+            };
+            break;
+    }
+}
+
+//decode returns the text of a message that the server relayed as binary data
+const decode = data => typeof data == `string` ? data : new TextDecoder().decode(data);
+
+function eventHandler({type, data}) {
+    if(type == `ping`) //heartbeat of the server, which considers this user disconnected without an answer
+        return rtc.events.send(JSON.stringify({type: `pong`, data}));
+    console.log(`event`, type, data);
+    type == `kicked` && alert(data);
+    type == `replay` && data.state == `started` && clearWhiteboard(); //the whiteboard is redrawn as it was drawn
+}
+
+//socketChannel mimics a DataChannel with the given label that is sent over the signaling WebSocket
+function socketChannel(send, label) {
+    return {
+        label,
+        get readyState() { return ws.readyState == WebSocket.OPEN ? `open` : `closed`; },
+        send: data => send(`message`, {channel: label, data}),
+    };
+}
+
+// chat
+
+function chatHandler() {
+    if(window.rtc && rtc.chat && rtc.chat.readyState == `open` && chatInput.value.trim())
+        rtc.chat.send(JSON.stringify({content: chatInput.value}));
+    chatInput.value = ``;
+    return false;
+}
+
+function chatSend(request) {
+    window.rtc && rtc.chat && rtc.chat.readyState == `open` && rtc.chat.send(JSON.stringify(request));
+}
+
+const react = (id, emoji) => chatSend({react: {id, emoji}}), //toggles the reaction of this user
+      deleteMessage = id => chatSend({delete: id});
+
+function chatLogger({id, sender, segments, time, audience, to, system, reactions, deleted}) {
+    if(deleted)
+        return deletionLogger(id);
+    const entry = document.createElement(`li`),
+          name = document.createElement(`b`);
+    entry.dataset.id = id;
+    entry.ondblclick = () => react(id, `👍`);
+    name.textContent = audience == `everyone` ? sender : `${sender} → ${to}`; //never render chat as HTML
+    system && entry.classList.add(`system`);
+    name.title = new Date(time).toLocaleTimeString();
+    entry.append(name, ` `, ...segments.map(({text, style, mention}) => {
+        const segment = document.createElement(`span`);
+        segment.textContent = text;
+        style && segment.classList.add(style); //style tokens are never markup
+        mention && segment.classList.add(`mention`);
+        return segment;
+    }));
+    chatLog.append(entry);
+    reactions && reactionLogger({id, counts: reactions});
+    chatLog.scrollTop = chatLog.scrollHeight;
+}
+
+function reactionLogger({id, counts}) {
+    const entry = chatLog.querySelector(`li[data-id="${id}"]`);
+    if(!entry)
+        return;
+    let reactions = entry.querySelector(`.reactions`);
+    if(!reactions) {
+        reactions = document.createElement(`span`);
+        reactions.classList.add(`reactions`);
+        entry.append(` `, reactions);
+    }
+    reactions.textContent = Object.entries(counts).map(([emoji, count]) => `${emoji} ${count}`).join(` `);
+}
+
+function deletionLogger(id) {
+    chatLog.querySelector(`li[data-id="${id}"]`)?.remove();
+}
+
+// voice chat
+
+const voice = {microphone: null, muted: false, pushToTalk: false, talking: false};
+
+//voiceHandler turns the microphone on, the server then sends a new offer to publish it
+async function voiceHandler() {
+    if(voice.microphone)
+        return;
+    const stream = await navigator.mediaDevices.getUserMedia({audio: true});
+    voice.microphone = stream.getAudioTracks()[0];
+    voiceControl({});
+    ws.signal(`renegotiate`);
+}
+
+//publishVoice sends the microphone over the first audio transceiver, which the server offers for this user's voice
+function publishVoice(rtc) {
+    const transceiver = rtc.getTransceivers().find(t => t.receiver.track.kind == `audio`);
+    if(!voice.microphone || !transceiver || transceiver.sender.track)
+        return;
+    transceiver.sender.replaceTrack(voice.microphone);
+    transceiver.direction = `sendonly`;
+}
+
+//voiceControl changes the state of the microphone and reports it to the server, which stops forwarding muted users
+function voiceControl(change) {
+    Object.assign(voice, change);
+    if(voice.microphone)
+        voice.microphone.enabled = !voice.muted && (!voice.pushToTalk || voice.talking);
+    const {muted, pushToTalk, talking} = voice;
+    window.rtc && rtc.events && rtc.events.readyState == `open` && rtc.events.send(JSON.stringify({type: `voice`, data: {muted, pushToTalk, talking}}));
+}
+
+const toggleMute = () => voiceControl({muted: !voice.muted}),
+      togglePushToTalk = () => voiceControl({pushToTalk: !voice.pushToTalk});
+document.addEventListener(`keydown`, e => e.key == `v` && voice.pushToTalk && !voice.talking && e.target == document.body && voiceControl({talking: true}));
+document.addEventListener(`keyup`, e => e.key == `v` && voice.talking && voiceControl({talking: false}));
+
+function speakerSetup(track, stream) {
+    const speaker = document.createElement(`audio`);
+    speaker.autoplay = true;
+    speaker.dataset.user = stream.id;
+    speaker.srcObject = stream;
+    document.body.append(speaker);
+    track.onended = stream.onremovetrack = () => speaker.remove();
+}
+
 // set up drawing on the whiteboard
 
 function whiteboardSetup() {
@@ -116,10 +301,17 @@ function startDrawing(e) {
 }
 
 function stopDrawing() {
+    sendStroke(); //the end of the line
+    cancelAnimationFrame(whiteboard.frame);
+    whiteboard.frame = null;
     whiteboard.isDrawing = false;
-    whiteboard.brush.beginPath();
+    whiteboard.last = null;
 }
 
+//pointers report movement as often as the display refreshes, strokes are sent at most once per animation frame and
+//`STROKE_INTERVAL` apart so that fast displays stay well within the server's drawing budget
+const STROKE_INTERVAL = 1000 / 30;
+
 function drawHandler(e) {
     e.preventDefault();
     if(whiteboard.isDrawing) {
@@ -130,9 +322,57 @@ function drawHandler(e) {
             x = touch.pageX - whiteboard.offsetLeft;
             y = touch.pageY - whiteboard.offsetTop;
         }
-        whiteboard.brush.lineTo(x, y);
-        whiteboard.brush.stroke();
-        whiteboard.brush.beginPath();
-        whiteboard.brush.moveTo(x, y);
+        whiteboard.pending = [x, y];
+        whiteboard.frame = whiteboard.frame || requestAnimationFrame(throttleStroke);
     }
+}
+
+//throttleStroke sends the pending stroke once `STROKE_INTERVAL` has passed since the last one
+function throttleStroke() {
+    const early = whiteboard.pending && performance.now() - whiteboard.sent < STROKE_INTERVAL;
+    whiteboard.frame = early ? requestAnimationFrame(throttleStroke) : null;
+    early || sendStroke();
+}
+
+//sendStroke draws and sends a segment from the last point that was sent to the latest point of the pointer
+function sendStroke() {
+    if(!whiteboard.pending)
+        return;
+    const [x, y] = whiteboard.pending,
+          [x0, y0] = whiteboard.last || [x, y],
+          segment = {x0, y0, x1: x, y1: y, color: whiteboard.brush.strokeStyle, width: whiteboard.brush.lineWidth};
+    whiteboard.last = whiteboard.pending;
+    whiteboard.pending = null;
+    whiteboard.sent = performance.now();
+    shareHandler(segment);
+    window.rtc && rtc.strokes && rtc.strokes.readyState == `open` && rtc.strokes.send(JSON.stringify(segment));
+}
+
+//shareHandler draws a segment of the whiteboard, the server renders time-lapses from the same segments
+function shareHandler({x0, y0, x1, y1, color, width}) {
+    const brush = whiteboard.brush,
+          [style, lineWidth] = [brush.strokeStyle, brush.lineWidth];
+    brush.strokeStyle = color;
+    brush.lineWidth = width;
+    brush.beginPath();
+    brush.moveTo(x0, y0);
+    brush.lineTo(x1, y1);
+    brush.stroke();
+    [brush.strokeStyle, brush.lineWidth] = [style, lineWidth];
+}
+
+function clearWhiteboard() {
+    whiteboard.brush.fillStyle = `white`;
+    whiteboard.brush.fillRect(0, 0, whiteboard.width, whiteboard.height);
+}
+
+// replay
+
+//replayHandler asks the server to redraw the whiteboard at 1x to 16x speed over the whiteboard channel, 0 skips to the end
+function replayHandler(speed) {
+    window.rtc && rtc.strokes && rtc.strokes.readyState == `open` && rtc.strokes.send(JSON.stringify({replay: {speed}}));
+}
+
+function timelapseHandler() {
+    location.href = `/timelapse`; //downloaded as a GIF
 }
\ No newline at end of file
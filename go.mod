@@ -6,6 +6,11 @@ require (
 	github.com/gorilla/securecookie v1.1.1
 	github.com/gorilla/sessions v1.2.1
 	github.com/gorilla/websocket v1.4.2
+	github.com/pion/interceptor v0.1.4
+	github.com/pion/logging v0.2.2
+	github.com/pion/rtp v1.7.4
+	github.com/pion/transport v0.13.0
+	github.com/pion/turn/v2 v2.0.6
 	github.com/pion/webrtc/v3 v3.1.11
 )
 
@@ -14,18 +19,13 @@ require (
 	github.com/pion/datachannel v1.5.2 // indirect
 	github.com/pion/dtls/v2 v2.0.13 // indirect
 	github.com/pion/ice/v2 v2.1.17 // indirect
-	github.com/pion/interceptor v0.1.4 // indirect
-	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/mdns v0.0.5 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
 	github.com/pion/rtcp v1.2.9 // indirect
-	github.com/pion/rtp v1.7.4 // indirect
 	github.com/pion/sctp v1.8.2 // indirect
 	github.com/pion/sdp/v3 v3.0.4 // indirect
 	github.com/pion/srtp/v2 v2.0.5 // indirect
 	github.com/pion/stun v0.3.5 // indirect
-	github.com/pion/transport v0.13.0 // indirect
-	github.com/pion/turn/v2 v2.0.6 // indirect
 	github.com/pion/udp v0.1.1 // indirect
 	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871 // indirect
 	golang.org/x/net v0.0.0-20211201190559-0a0e4e1bb54c // indirect
@@ -0,0 +1,255 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"Palette/lobby/user"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//MAX_MESSAGE_LENGTH is the maximum number of characters in the content of a chat message
+const MAX_MESSAGE_LENGTH = 500
+
+//Audiences of a chat message
+const (
+	EVERYONE = `everyone` //every user in the lobby
+	USER     = `user`     //a single user named by `Message.To`, ie. a whisper
+	GROUP    = `group`    //every user in the role group named by `Message.To`
+)
+
+//Role groups that can be addressed by a chat message
+const (
+	MODERATORS = `moderators` //the host and users with the `moderators` attribute
+	GUESSED    = `guessed`    //users with the `guessed` attribute, ie. users that have already guessed the word
+)
+
+var groups = map[string]bool{MODERATORS: true, GUESSED: true}
+
+//Message represents a chat message to be broadcasted to every user or a specific user in a lobby.
+//Messages addressed to a user or a group are also delivered to their sender. `Content` is the plain
+//text of the message, clients display the rich text `Segments` instead, see `Segment`
+type Message struct {
+	ID        int                        `json:"id"` //assigned by the lobby on delivery, every message has a greater ID than the ones before it
+	Sender    string                     `json:"sender"`
+	Content   string                     `json:"content"`
+	Segments  []Segment                  `json:"segments"`
+	Time      string                     `json:"time"`
+	Audience  string                     `json:"audience"`
+	To        string                     `json:"to,omitempty"`        //name of the user or group the message is addressed to
+	System    bool                       `json:"system,omitempty"`    //sent by the server as `user.SERVER_NAME`
+	Reactions map[string]int             `json:"reactions,omitempty"` //number of users that reacted with each emoji, see `Lobby.React()`
+	Deleted   bool                       `json:"deleted,omitempty"`   //the content of deleted messages is removed, see `Lobby.Delete()`
+	reactors  map[string]map[string]bool //names of the users that reacted with each emoji
+	departed  bool                       //the sender has left, so only a moderator can delete the message
+}
+
+//ParseMessage parses a chat message in the form of `{"content": "...", "audience": "...", "to": "..."}` received
+//from a user where the audience defaults to `EVERYONE`. Only the content and addressing are taken from the user,
+//the sender is always the given name and the time is set by the server.
+//Returns an error if the message is malformed, empty or too long
+func ParseMessage(sender string, data []byte) (Message, error) {
+	msg := Message{}
+	if e := json.Unmarshal(data, &msg); e != nil {
+		return Message{}, fmt.Errorf(`invalid message from '%v': %v`, sender, e)
+	}
+	return newMessage(sender, msg.Content, msg.Audience, msg.To)
+}
+
+//newMessage is a constructor for a chat message from a user that validates its content and addressing
+func newMessage(sender, content, audience, to string) (Message, error) {
+	content = strings.TrimSpace(content)
+	if content == `` {
+		return Message{}, fmt.Errorf(`invalid message from '%v': message is empty`, sender)
+	}
+	if utf8.RuneCountInString(content) > MAX_MESSAGE_LENGTH {
+		return Message{}, fmt.Errorf(`invalid message from '%v': message is longer than %v characters`, sender, MAX_MESSAGE_LENGTH)
+	}
+	switch audience {
+	case ``, EVERYONE:
+		audience, to = EVERYONE, ``
+	case USER, GROUP:
+		if to == `` {
+			return Message{}, fmt.Errorf(`invalid message from '%v': no recipient given`, sender)
+		}
+	default:
+		return Message{}, fmt.Errorf(`invalid message from '%v': unknown audience '%v'`, sender, audience)
+	}
+	return Message{
+		Sender:   sender,
+		Content:  content,
+		Segments: []Segment{Text(content)}, //users can only send plain text
+		Time:     timestamp(),
+		Audience: audience,
+		To:       to,
+	}, nil
+}
+
+//timestamp returns the current time of the server, to be used as the time of a message
+func timestamp() string { return time.Now().UTC().Format(time.RFC3339) }
+
+//Notice sends a system message from `user.SERVER_NAME` made up of rich text segments to the given audience
+//of a lobby, see `Message`. Returns an error if the lobby is shutting down
+func (lobby *Lobby) Notice(audience, to string, segments ...Segment) error {
+	for i := range segments {
+		if !styles[segments[i].Style] {
+			segments[i].Style = PLAIN
+		}
+	}
+	return lobby.Send(Message{
+		Sender:   user.SERVER_NAME,
+		Content:  plainText(segments),
+		Segments: segments,
+		Time:     timestamp(),
+		Audience: audience,
+		To:       to,
+		System:   true,
+	})
+}
+
+//Receive handles a chat message sent by a user over their `chat` channel and delivers it to its audience.
+//Messages that start with `/` are run as commands, see `Lobby.Run()`. Requests for older messages are answered
+//with a page of the lobby's chat history instead and reactions and deletions are applied to the referenced message.
+//If the user has not joined the lobby, is muted for flooding, the message is invalid or the lobby is shutting down,
+//the user is notified and the error is returned
+func (lobby *Lobby) Receive(sender *user.User, data []byte) error {
+	e := lobby.receive(sender, data)
+	if e != nil {
+		notify(sender, Event{`error`, e.Error()})
+	}
+	return e
+}
+
+//receive is the notification free version of Receive(). Internal use only!
+func (lobby *Lobby) receive(sender *user.User, data []byte) error {
+	name := sender.Name()
+	if lobby.GetUser(name) != sender {
+		return fmt.Errorf(`unable to send message to lobby: '%v': '%v' has not joined this lobby`, lobby.Name(), name)
+	}
+	if lobby.muted(sender) { //commands and requests included, a muted user would keep flooding until they are kicked
+		return fmt.Errorf(`unable to send message to lobby: '%v': '%v' is muted for flooding`, lobby.Name(), name)
+	}
+	request := struct { //requests that are not messages, see `Lobby.Receive()`
+		History *struct { //`{"history": {"before": 100, "limit": 50}}`
+			Before int `json:"before"`
+			Limit  int `json:"limit"`
+		} `json:"history"`
+		React *struct { //`{"react": {"id": 42, "emoji": "👍"}}`
+			ID    int    `json:"id"`
+			Emoji string `json:"emoji"`
+		} `json:"react"`
+		Delete int `json:"delete"` //`{"delete": 42}`
+	}{}
+	if json.Unmarshal(data, &request) == nil {
+		switch {
+		case request.History != nil:
+			if !lobby.Allow(sender, TRAFFIC_COMMANDS) {
+				return fmt.Errorf(`unable to send chat history to '%v': too many requests`, name)
+			}
+			return lobby.SendHistory(sender, request.History.Before, request.History.Limit)
+		case request.React != nil:
+			if !lobby.Allow(sender, TRAFFIC_CHAT) {
+				return fmt.Errorf(`unable to react to message %v: '%v' is reacting too quickly`, request.React.ID, name)
+			}
+			return lobby.React(sender, request.React.ID, request.React.Emoji)
+		case request.Delete != 0:
+			if !lobby.Allow(sender, TRAFFIC_CHAT) {
+				return fmt.Errorf(`unable to delete message %v: '%v' is deleting too quickly`, request.Delete, name)
+			}
+			return lobby.Delete(sender, request.Delete)
+		}
+	}
+	msg, e := ParseMessage(name, data)
+	if e != nil {
+		return e
+	}
+	if strings.HasPrefix(msg.Content, `/`) {
+		if !lobby.Allow(sender, TRAFFIC_COMMANDS) {
+			return fmt.Errorf(`unable to run command from '%v': too many commands`, name)
+		}
+		if e := lobby.Run(sender, msg.Content); e != nil {
+			lobby.Notice(USER, name, Styled(NEGATIVE, e.Error()))
+			return e
+		}
+		return nil
+	}
+	if !lobby.Allow(sender, TRAFFIC_CHAT) {
+		return fmt.Errorf(`unable to send message to lobby: '%v': '%v' is sending messages too quickly`, lobby.Name(), name)
+	}
+	return lobby.send(sender, msg)
+}
+
+//send checks that the sender of a message is not muted and its recipient exists,
+//then runs it through the chat pipeline before sending it. Internal use only!
+func (lobby *Lobby) send(sender *user.User, msg Message) error {
+	name := sender.Name()
+	if lobby.muted(sender) {
+		return fmt.Errorf(`unable to send message to lobby: '%v': '%v' is muted for flooding`, lobby.Name(), name)
+	}
+	switch msg.Audience {
+	case USER:
+		if lobby.GetUser(msg.To) == nil {
+			return fmt.Errorf(`unable to whisper to '%v': '%v' has not joined this lobby`, msg.To, msg.To)
+		}
+	case GROUP:
+		if !groups[msg.To] {
+			return fmt.Errorf(`unable to send message to '%v': unknown group`, msg.To)
+		}
+		lobby.RLock()
+		member := lobby.inGroup(sender, msg.To)
+		lobby.RUnlock()
+		if !member && msg.To != MODERATORS { //anyone can reach the moderators
+			return fmt.Errorf(`unable to send message to '%v': '%v' is not a member of this group`, msg.To, name)
+		}
+	}
+	if e := lobby.filterMessage(sender, &msg); e != nil {
+		return e
+	}
+	return lobby.Send(msg)
+}
+
+//deliver assigns the next ID to a message and sends it to every user of its audience. Only messages addressed to
+//everyone are kept in the lobby's chat history as the history is available to every user. Internal use only!
+func (lobby *Lobby) deliver(msg Message) {
+	lobby.lastID++
+	msg.ID = lobby.lastID
+	bin, _ := json.Marshal(msg)
+	if msg.Audience == EVERYONE {
+		lobby.history.add(msg)
+		if lobby.recorder != nil { //private messages are never recorded
+			lobby.recorder.Chat(bin)
+		}
+	}
+	for _, user := range lobby.users {
+		if !lobby.receives(user, msg) {
+			continue
+		}
+		user.SendChat(bin) //users that are trying to reconnect are skipped
+	}
+	lobby.notifyMentions(msg)
+}
+
+//receives reports whether a user is part of the audience of a message. Internal use only!
+func (lobby *Lobby) receives(usr *user.User, msg Message) bool {
+	name := usr.Name()
+	switch msg.Audience {
+	case EVERYONE:
+		return true
+	case USER:
+		return name == msg.To || name == msg.Sender
+	case GROUP:
+		return name == msg.Sender || lobby.inGroup(usr, msg.To)
+	}
+	return false
+}
+
+//inGroup reports whether a user is a member of a role group. Internal use only!
+func (lobby *Lobby) inGroup(usr *user.User, group string) bool {
+	if group == MODERATORS && usr == lobby.host {
+		return true
+	}
+	member, _ := usr.Attribute(group).(bool)
+	return member
+}
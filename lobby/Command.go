@@ -0,0 +1,375 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"Palette/lobby/user"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Permission is the role a user needs in order to run a command
+type Permission int
+
+const (
+	ALLOW_ANYONE     Permission = iota
+	ALLOW_MODERATORS            //the host and users in the `MODERATORS` group
+	ALLOW_HOST
+)
+
+func (permission Permission) String() string {
+	switch permission {
+	case ALLOW_ANYONE:
+		return `anyone`
+	case ALLOW_MODERATORS:
+		return `moderators`
+	case ALLOW_HOST:
+		return `the host`
+	}
+	return fmt.Sprintf(`Permission(%d)`, int(permission))
+}
+
+//ArgType is the type of an argument of a command, it decides how the argument is parsed
+type ArgType int
+
+const (
+	ARG_STRING ArgType = iota //a single word or a "quoted string"
+	ARG_INT                   //a whole number between `Arg.Min` and `Arg.Max`
+	ARG_USER                  //the name of a user that has joined the lobby, parsed as a `*user.User`
+	ARG_TEXT                  //the rest of the line as-is, must be the last argument
+)
+
+//Arg describes an argument of a command
+type Arg struct {
+	Name     string
+	Type     ArgType
+	Optional bool //optional arguments must come after every required argument
+	Min, Max int  //range of `ARG_INT` arguments, ignored if both are 0
+}
+
+//usage returns the usage of an argument such as `<name>` or `[name]` if it is optional
+func (arg Arg) usage() string {
+	if arg.Optional {
+		return `[` + arg.Name + `]`
+	}
+	return `<` + arg.Name + `>`
+}
+
+/*
+	Command is a slash command that can be run by a user in the chat of a lobby, such as `/rounds 5`.
+
+	Every command declares its arguments so that they are parsed and validated before the command is run, which
+	means `Run` only ever sees well-formed arguments. Commands are added to a `Registry`, either the global `Commands`
+	registry that every lobby uses or the registry of a single lobby from `Lobby.Commands()`, ie. by a game mode.
+*/
+type Command struct {
+	Name       string
+	Aliases    []string
+	Args       []Arg
+	Permission Permission
+	Help       string
+	Run        func(call *Call) error
+}
+
+//Usage returns the usage of a command such as `/rounds <n>`
+func (cmd *Command) Usage() string {
+	usage := `/` + cmd.Name
+	for _, arg := range cmd.Args {
+		usage += ` ` + arg.usage()
+	}
+	return usage
+}
+
+//Call is a single use of a command by a user with the parsed values of its arguments
+type Call struct {
+	Lobby   *Lobby
+	Sender  *user.User
+	Command *Command
+	args    map[string]interface{}
+}
+
+//String returns the value of an `ARG_STRING` or `ARG_TEXT` argument, `` if it was not given
+func (call *Call) String(name string) string {
+	value, _ := call.args[name].(string)
+	return value
+}
+
+//Int returns the value of an `ARG_INT` argument, 0 if it was not given
+func (call *Call) Int(name string) int {
+	value, _ := call.args[name].(int)
+	return value
+}
+
+//User returns the value of an `ARG_USER` argument, `nil` if it was not given
+func (call *Call) User(name string) *user.User {
+	value, _ := call.args[name].(*user.User)
+	return value
+}
+
+//Has reports whether an optional argument was given
+func (call *Call) Has(name string) bool {
+	_, given := call.args[name]
+	return given
+}
+
+//Reply sends a system message to the user that ran the command
+func (call *Call) Reply(segments ...Segment) error {
+	return call.Lobby.Notice(USER, call.Sender.Name(), segments...)
+}
+
+// === Errors === //
+
+//UnknownCommandError is returned when a user runs a command that does not exist
+type UnknownCommandError struct{ Name string }
+
+func (e *UnknownCommandError) Error() string {
+	return fmt.Sprintf(`unknown command: '/%v', type /help for a list of commands`, e.Name)
+}
+
+//PermissionError is returned when a user runs a command that they are not allowed to run
+type PermissionError struct {
+	Command  string
+	Required Permission
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf(`only %v can use /%v`, e.Required, e.Command)
+}
+
+//ArgumentError is returned when the arguments given to a command do not match the arguments it declares
+type ArgumentError struct {
+	Command, Arg, Reason, Usage string
+}
+
+func (e *ArgumentError) Error() string {
+	if e.Arg == `` {
+		return fmt.Sprintf(`invalid use of /%v: %v. usage: %v`, e.Command, e.Reason, e.Usage)
+	}
+	return fmt.Sprintf(`invalid argument '%v' for /%v: %v. usage: %v`, e.Arg, e.Command, e.Reason, e.Usage)
+}
+
+// === Registry === //
+
+//Registry is a thread safe collection of commands. A registry falls back to the commands of its parent, if any
+type Registry struct {
+	commands map[string]*Command //commands by name and aliases
+	parent   *Registry
+	sync.RWMutex
+}
+
+//Commands is the global registry of commands that is available in every lobby
+var Commands = NewRegistry(nil)
+
+//Constructor for a command registry that falls back to the commands of `parent`, which may be `nil`
+func NewRegistry(parent *Registry) *Registry {
+	return &Registry{
+		commands: make(map[string]*Command),
+		parent:   parent,
+		RWMutex:  sync.RWMutex{},
+	}
+}
+
+//Register adds a command to a registry. Returns an error if the command is malformed
+//or its name or one of its aliases is already in use by another command of the registry
+func (registry *Registry) Register(cmd Command) error {
+	if cmd.Name == `` || cmd.Run == nil {
+		return fmt.Errorf(`unable to register command: a command needs a name and a 'Run' function`)
+	}
+	optional := false
+	for i, arg := range cmd.Args {
+		if arg.Type == ARG_TEXT && i != len(cmd.Args)-1 {
+			return fmt.Errorf(`unable to register /%v: '%v' takes the rest of the line and must be the last argument`, cmd.Name, arg.Name)
+		}
+		if optional && !arg.Optional {
+			return fmt.Errorf(`unable to register /%v: required argument '%v' comes after an optional argument`, cmd.Name, arg.Name)
+		}
+		optional = optional || arg.Optional
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	names := append([]string{cmd.Name}, cmd.Aliases...)
+	for _, name := range names {
+		if registry.commands[strings.ToLower(name)] != nil {
+			return fmt.Errorf(`unable to register /%v: '/%v' is already in use`, cmd.Name, name)
+		}
+	}
+	for _, name := range names {
+		registry.commands[strings.ToLower(name)] = &cmd
+	}
+	return nil
+}
+
+//Lookup returns a command given its name or one of its aliases, `nil` if it does not exist
+func (registry *Registry) Lookup(name string) *Command {
+	registry.RLock()
+	cmd := registry.commands[strings.ToLower(name)]
+	registry.RUnlock()
+	if cmd == nil && registry.parent != nil {
+		return registry.parent.Lookup(name)
+	}
+	return cmd
+}
+
+//List returns every command of a registry and its parents sorted by name.
+//Commands of a registry take precedence over the commands of its parent with the same name
+func (registry *Registry) List() []*Command {
+	seen := make(map[string]bool)
+	list := make([]*Command, 0)
+	for r := registry; r != nil; r = r.parent {
+		r.RLock()
+		for name, cmd := range r.commands {
+			if name == strings.ToLower(cmd.Name) && !seen[name] {
+				seen[name] = true
+				list = append(list, cmd)
+			}
+		}
+		r.RUnlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// === Running Commands === //
+
+//token is a word of a command and its position in the line
+type token struct {
+	text  string
+	start int
+}
+
+//tokenizer splits a line into words one at a time, so that the rest of the line can be taken as-is once an
+//`ARG_TEXT` argument is reached, whatever it contains
+type tokenizer struct {
+	line string
+	i    int //position of the next word
+}
+
+//next returns the next word of the line, `false` once no words are left. Words in double quotes can contain spaces
+//and `\"` is a literal quote. Returns an error if a quote is not closed
+func (t *tokenizer) next() (token, bool, error) {
+	line := t.line
+	start, ok := t.skip()
+	if !ok {
+		return token{}, false, nil
+	}
+	i := start
+	if line[i] != '"' {
+		for i < len(line) && line[i] != ' ' {
+			i++
+		}
+		t.i = i
+		return token{line[start:i], start}, true, nil
+	}
+	word := strings.Builder{}
+	for i++; i < len(line) && line[i] != '"'; i++ {
+		if line[i] == '\\' && i+1 < len(line) && line[i+1] == '"' {
+			i++
+		}
+		word.WriteByte(line[i])
+	}
+	if i == len(line) {
+		return token{}, false, fmt.Errorf(`missing closing quote`)
+	}
+	t.i = i + 1 //skip the closing quote
+	return token{word.String(), start}, true, nil
+}
+
+//rest returns the rest of the line from the start of the next word, `false` if only spaces are left
+func (t *tokenizer) rest() (token, bool) {
+	start, ok := t.skip()
+	if !ok {
+		return token{}, false
+	}
+	t.i = len(t.line)
+	return token{strings.TrimSpace(t.line[start:]), start}, true
+}
+
+//skip skips the spaces before the next word and returns its position, `false` if only spaces are left. Internal use only!
+func (t *tokenizer) skip() (int, bool) {
+	for t.i < len(t.line) && t.line[t.i] == ' ' {
+		t.i++
+	}
+	return t.i, t.i < len(t.line)
+}
+
+//Commands is an accessor for a lobby's registry of commands, which falls back to the global `Commands`.
+//Game modes can register commands that should only be available in this lobby. It is immutable
+func (lobby *Lobby) Commands() *Registry { return lobby.commands }
+
+//Run runs a command such as `/rounds 5` on behalf of a user. Returns an `*UnknownCommandError`, a
+//`*PermissionError` or an `*ArgumentError` if the command cannot be run, otherwise the error of the command itself
+func (lobby *Lobby) Run(sender *user.User, line string) error {
+	line = strings.TrimPrefix(strings.TrimSpace(line), `/`)
+	words := &tokenizer{line: line}
+	first, ok, e := words.next()
+	if e != nil || !ok {
+		name := strings.SplitN(line, ` `, 2)[0]
+		if cmd := lobby.commands.Lookup(name); cmd != nil && e != nil {
+			return &ArgumentError{cmd.Name, ``, e.Error(), cmd.Usage()}
+		}
+		return &UnknownCommandError{name}
+	}
+	cmd := lobby.commands.Lookup(first.text)
+	if cmd == nil {
+		return &UnknownCommandError{first.text}
+	}
+	if !lobby.permitted(sender, cmd.Permission) {
+		return &PermissionError{cmd.Name, cmd.Permission}
+	}
+	call := &Call{lobby, sender, cmd, make(map[string]interface{})}
+	for _, arg := range cmd.Args {
+		var word token
+		if arg.Type == ARG_TEXT { //the rest of the line belongs to this argument, quotes and all
+			word, ok = words.rest()
+		} else if word, ok, e = words.next(); e != nil {
+			return &ArgumentError{cmd.Name, arg.Name, e.Error(), cmd.Usage()}
+		}
+		if !ok {
+			if !arg.Optional {
+				return &ArgumentError{cmd.Name, arg.Name, `missing argument`, cmd.Usage()}
+			}
+			break
+		}
+		value := word.text
+		switch arg.Type {
+		case ARG_STRING, ARG_TEXT:
+			call.args[arg.Name] = value
+		case ARG_INT:
+			n, e := strconv.Atoi(value)
+			if e != nil {
+				return &ArgumentError{cmd.Name, arg.Name, fmt.Sprintf(`'%v' is not a whole number`, value), cmd.Usage()}
+			}
+			if (arg.Min != 0 || arg.Max != 0) && (n < arg.Min || n > arg.Max) {
+				return &ArgumentError{cmd.Name, arg.Name, fmt.Sprintf(`must be between %v and %v`, arg.Min, arg.Max), cmd.Usage()}
+			}
+			call.args[arg.Name] = n
+		case ARG_USER:
+			usr := lobby.GetUser(value)
+			if usr == nil {
+				return &ArgumentError{cmd.Name, arg.Name, fmt.Sprintf(`'%v' has not joined this lobby`, value), cmd.Usage()}
+			}
+			call.args[arg.Name] = usr
+		}
+	}
+	if _, ok, e := words.next(); ok || e != nil {
+		return &ArgumentError{cmd.Name, ``, `too many arguments`, cmd.Usage()}
+	}
+	return cmd.Run(call)
+}
+
+//permitted reports whether a user has the given permission in a lobby
+func (lobby *Lobby) permitted(usr *user.User, permission Permission) bool {
+	lobby.RLock()
+	defer lobby.RUnlock()
+	switch permission {
+	case ALLOW_ANYONE:
+		return true
+	case ALLOW_MODERATORS:
+		return lobby.inGroup(usr, MODERATORS)
+	case ALLOW_HOST:
+		return usr == lobby.host
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"fmt"
+	"strings"
+)
+
+//The built-in commands that are available in every lobby
+func init() {
+	for _, cmd := range []Command{
+		{
+			Name: `help`,
+			Args: []Arg{{Name: `command`, Type: ARG_STRING, Optional: true}},
+			Help: `lists the commands you can use or explains a single command`,
+			Run:  help,
+		},
+		{
+			Name:    `w`,
+			Aliases: []string{`whisper`, `msg`},
+			Args:    []Arg{{Name: `user`, Type: ARG_USER}, {Name: `message`, Type: ARG_TEXT}},
+			Help:    `sends a private message that only you and the user can see`,
+			Run: func(call *Call) error {
+				msg, e := newMessage(call.Sender.Name(), call.String(`message`), USER, call.User(`user`).Name())
+				if e != nil {
+					return e
+				}
+				return call.Lobby.send(call.Sender, msg)
+			},
+		},
+		{
+			Name:    `users`,
+			Aliases: []string{`players`},
+			Help:    `lists the users in this lobby`,
+			Run: func(call *Call) error {
+				lobby := call.Lobby
+				lobby.RLock()
+				names := make([]string, 0, len(lobby.users))
+				for name, usr := range lobby.users {
+					switch {
+					case usr == lobby.host:
+						name += ` (host)`
+					case lobby.inGroup(usr, MODERATORS):
+						name += ` (moderator)`
+					}
+					names = append(names, name)
+				}
+				waiting := len(lobby.queue)
+				lobby.RUnlock()
+				reply := []Segment{Styled(BOLD, fmt.Sprintf(`%v users: `, len(names))), Text(strings.Join(names, `, `))}
+				if waiting > 0 {
+					reply = append(reply, Text(fmt.Sprintf(` (%v waiting)`, waiting)))
+				}
+				return call.Reply(reply...)
+			},
+		},
+		{
+			Name:       `rounds`,
+			Args:       []Arg{{Name: `rounds`, Type: ARG_INT, Min: MIN_ROUNDS, Max: MAX_ROUNDS}},
+			Permission: ALLOW_HOST,
+			Help:       `sets the number of rounds`,
+			Run:        setting(func(settings *Settings, call *Call) { settings.Rounds = call.Int(`rounds`) }),
+		},
+		{
+			Name:       `time`,
+			Aliases:    []string{`duration`},
+			Args:       []Arg{{Name: `seconds`, Type: ARG_INT, Min: MIN_DURATION, Max: MAX_DURATION}},
+			Permission: ALLOW_HOST,
+			Help:       `sets the duration of a round`,
+			Run:        setting(func(settings *Settings, call *Call) { settings.Duration = call.Int(`seconds`) }),
+		},
+		{
+			Name:       `capacity`,
+			Args:       []Arg{{Name: `users`, Type: ARG_INT, Min: MIN_CAPACITY, Max: MAX_CAPACITY}},
+			Permission: ALLOW_HOST,
+			Help:       `sets the maximum number of users before new users have to wait`,
+			Run:        setting(func(settings *Settings, call *Call) { settings.Capacity = call.Int(`users`) }),
+		},
+		{
+			Name:       `filter`,
+			Args:       []Arg{{Name: `mask|block|flag|off`, Type: ARG_STRING}},
+			Permission: ALLOW_HOST,
+			Help:       `sets what happens to chat messages that contain a filtered word`,
+			Run:        setting(func(settings *Settings, call *Call) { settings.Filter = call.String(`mask|block|flag|off`) }),
+		},
+		{
+			Name:       `host`,
+			Args:       []Arg{{Name: `user`, Type: ARG_USER}},
+			Permission: ALLOW_HOST,
+			Help:       `makes another user the host of this lobby`,
+			Run: func(call *Call) error {
+				if e := call.Lobby.SetHost(call.User(`user`).Name()); e != nil {
+					return e
+				}
+				return call.Lobby.Notice(EVERYONE, ``, Styled(BOLD, call.User(`user`).Name()), Text(` is now the host`))
+			},
+		},
+		{
+			Name:       `mod`,
+			Args:       []Arg{{Name: `user`, Type: ARG_USER}},
+			Permission: ALLOW_HOST,
+			Help:       `makes a user a moderator`,
+			Run: func(call *Call) error {
+				call.User(`user`).SetAttribute(MODERATORS, true)
+				return call.Lobby.Notice(EVERYONE, ``, Styled(BOLD, call.User(`user`).Name()), Text(` is now a moderator`))
+			},
+		},
+		{
+			Name:       `unmod`,
+			Args:       []Arg{{Name: `user`, Type: ARG_USER}},
+			Permission: ALLOW_HOST,
+			Help:       `removes a user from the moderators`,
+			Run: func(call *Call) error {
+				call.User(`user`).SetAttribute(MODERATORS, nil)
+				return call.Lobby.Notice(EVERYONE, ``, Styled(BOLD, call.User(`user`).Name()), Text(` is no longer a moderator`))
+			},
+		},
+		{
+			Name:       `mutevoice`,
+			Args:       []Arg{{Name: `user`, Type: ARG_USER}},
+			Permission: ALLOW_HOST,
+			Help:       `mutes the voice of a user until you unmute them`,
+			Run: func(call *Call) error {
+				if e := call.Lobby.HostMute(call.Sender.Name(), call.User(`user`).Name(), true); e != nil {
+					return e
+				}
+				return call.Lobby.Notice(EVERYONE, ``, Styled(BOLD, call.User(`user`).Name()), Text(` has been muted by the host`))
+			},
+		},
+		{
+			Name:       `unmutevoice`,
+			Args:       []Arg{{Name: `user`, Type: ARG_USER}},
+			Permission: ALLOW_HOST,
+			Help:       `allows a user you have muted to speak again`,
+			Run: func(call *Call) error {
+				if e := call.Lobby.HostMute(call.Sender.Name(), call.User(`user`).Name(), false); e != nil {
+					return e
+				}
+				return call.Lobby.Notice(EVERYONE, ``, Styled(BOLD, call.User(`user`).Name()), Text(` can speak again`))
+			},
+		},
+	} {
+		if e := Commands.Register(cmd); e != nil {
+			panic(e) //the built-in commands are fixed, this can only happen during development
+		}
+	}
+}
+
+//help is the built-in `/help` command. The help text is generated from the registry of the lobby
+//so that commands added by game modes and plugins are always included
+func help(call *Call) error {
+	if call.Has(`command`) {
+		name := strings.TrimPrefix(call.String(`command`), `/`)
+		cmd := call.Lobby.commands.Lookup(name)
+		if cmd == nil {
+			return &UnknownCommandError{name}
+		}
+		reply := []Segment{Styled(CODE, cmd.Usage()), Text(` - ` + cmd.Help)}
+		if len(cmd.Aliases) > 0 {
+			reply = append(reply, Text(`. Also: /`+strings.Join(cmd.Aliases, `, /`)))
+		}
+		if cmd.Permission != ALLOW_ANYONE {
+			reply = append(reply, Styled(ITALIC, fmt.Sprintf(` (%v only)`, cmd.Permission)))
+		}
+		return call.Reply(reply...)
+	}
+	reply := []Segment{Styled(BOLD, `Commands:`)}
+	for _, cmd := range call.Lobby.commands.List() {
+		if call.Lobby.permitted(call.Sender, cmd.Permission) {
+			reply = append(reply, Text("\n"), Styled(CODE, cmd.Usage()), Text(` - `+cmd.Help))
+		}
+	}
+	return call.Reply(reply...)
+}
+
+//setting returns the `Run` function of a command that changes a single setting on behalf of the user that ran it
+func setting(change func(*Settings, *Call)) func(*Call) error {
+	return func(call *Call) error {
+		return call.Lobby.ChangeSettings(call.Sender.Name(), func(settings *Settings) error {
+			change(settings, call)
+			return nil
+		})
+	}
+}
@@ -0,0 +1,39 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"Palette/lobby/user"
+	"encoding/json"
+	"fmt"
+)
+
+//Control handles a control message sent by a user over their `events` channel in the same form as an `Event`:
+//
+//	{"type": "voice", "data": VoiceState} changes the voice state of the user, see `Lobby.SetVoice()`
+//
+//Returns an error if the user has not joined the lobby, the message is invalid or the user is over their presence
+//budget, see `Limits`
+func (lobby *Lobby) Control(sender *user.User, data []byte) error {
+	control := struct {
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}{}
+	if e := json.Unmarshal(data, &control); e != nil {
+		return fmt.Errorf(`invalid control message from '%v': %v`, sender.Name(), e)
+	}
+	if lobby.GetUser(sender.Name()) != sender {
+		return fmt.Errorf(`unable to handle control message: '%v' has not joined this lobby`, sender.Name())
+	}
+	if !lobby.Allow(sender, TRAFFIC_PRESENCE) { //push-to-talk changes state as often as a user presses their key
+		return fmt.Errorf(`unable to handle control message: '%v' is sending control messages too quickly`, sender.Name())
+	}
+	switch control.Type {
+	case `voice`:
+		state := VoiceState{}
+		if e := json.Unmarshal(control.Data, &state); e != nil {
+			return fmt.Errorf(`invalid voice state from '%v': %v`, sender.Name(), e)
+		}
+		return lobby.SetVoice(sender, state)
+	}
+	return fmt.Errorf(`invalid control message from '%v': unknown type '%v'`, sender.Name(), control.Type)
+}
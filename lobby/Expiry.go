@@ -0,0 +1,80 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"Palette/lobby/user"
+	"container/heap"
+	"time"
+)
+
+//expiry is the deadline for a disconnected user to reconnect before their data is deleted
+type expiry struct {
+	user                 *user.User
+	disconnect, deadline time.Time
+}
+
+//expiries is a min-heap of expiries ordered by deadline, to be used with `container/heap`
+type expiries []expiry
+
+func (e expiries) Len() int            { return len(e) }
+func (e expiries) Less(i, j int) bool  { return e[i].deadline.Before(e[j].deadline) }
+func (e expiries) Swap(i, j int)       { e[i], e[j] = e[j], e[i] }
+func (e *expiries) Push(x interface{}) { *e = append(*e, x.(expiry)) }
+func (e *expiries) Pop() interface{} {
+	old := *e
+	last := old[len(old)-1]
+	old[len(old)-1] = expiry{} //required for garbage collection
+	*e = old[:len(old)-1]
+	return last
+}
+
+//schedule is the `OnDisconnect()` handler of every user in a lobby. If the user has disconnected,
+//their deadline is added to the lobby's expiries. Either way, the `userManager()` goroutine is woken up
+func (lobby *Lobby) schedule(usr *user.User) {
+	if disconnect := usr.TimeDisconnect(); disconnect != user.NIL_TIME {
+		lobby.expiryLock.Lock()
+		heap.Push(&lobby.expiries, expiry{usr, disconnect, disconnect.Add(lobby.maxTimeout)})
+		lobby.expiryLock.Unlock()
+	}
+	lobby.signal()
+}
+
+//signal wakes up the `userManager()` goroutine without blocking
+func (lobby *Lobby) signal() {
+	select {
+	case lobby.wake <- struct{}{}:
+	default: //already signaled
+	}
+}
+
+//expire deletes the data of every user that has passed their deadline and returns the next deadline.
+//Entries of users that have reconnected or left since they were scheduled are discarded.
+//Returns `NIL_TIME` if there are no deadlines left. Internal use only!
+func (lobby *Lobby) expire() time.Time {
+	lobby.expiryLock.Lock()
+	defer lobby.expiryLock.Unlock()
+	for len(lobby.expiries) > 0 {
+		next := lobby.expiries[0]
+		if next.deadline.After(time.Now()) {
+			return next.deadline
+		}
+		heap.Pop(&lobby.expiries)
+		if next.user.TimeDisconnect().Equal(next.disconnect) && lobby.member(next.user) {
+			lobby.removeUser(next.user.Name())
+		}
+	}
+	return user.NIL_TIME
+}
+
+//member reports whether a user has joined or is waiting to join a lobby. Internal use only!
+func (lobby *Lobby) member(usr *user.User) bool {
+	if lobby.users[usr.Name()] == usr {
+		return true
+	}
+	for _, u := range lobby.queue {
+		if u == usr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"Palette/lobby/filter"
+	"Palette/lobby/user"
+	"fmt"
+)
+
+//Stage is a step of the chat pipeline. Every chat message sent by a user goes through the stages of a lobby in order
+//before it is delivered. A stage can change the message or return an error to stop it from being delivered
+type Stage func(lobby *Lobby, sender *user.User, msg *Message) error
+
+//AddStage adds a stage to the end of the chat pipeline of a lobby, ie. for a game mode that hides correct guesses
+func (lobby *Lobby) AddStage(stage Stage) {
+	lobby.Lock()
+	defer lobby.Unlock()
+	lobby.stages = append(lobby.stages, stage)
+}
+
+//filterMessage runs a message from a user through the chat pipeline of a lobby. Internal use only!
+func (lobby *Lobby) filterMessage(sender *user.User, msg *Message) error {
+	lobby.RLock()
+	stages := lobby.stages
+	lobby.RUnlock()
+	for _, stage := range stages {
+		if e := stage(lobby, sender, msg); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+//FilteredName reports whether a name, such as the username of a user who wants to join, matches the built-in or custom
+//filtered words of a lobby, see `filter.MatchesName()`
+func (lobby *Lobby) FilteredName(name string) bool {
+	lobby.RLock()
+	defer lobby.RUnlock()
+	return lobby.words.MatchesName(name)
+}
+
+//wordFilter is the stage of the chat pipeline that takes the lobby's filter action, see `filter.Actions`,
+//on messages that contain a built-in or custom filtered word. It is the first stage of every lobby
+func wordFilter(lobby *Lobby, sender *user.User, msg *Message) error {
+	lobby.RLock()
+	action, words := lobby.settings.Filter, lobby.words
+	lobby.RUnlock()
+	switch action {
+	case filter.MASK:
+		for i := range msg.Segments {
+			msg.Segments[i].Text, _ = words.Mask(msg.Segments[i].Text)
+		}
+		msg.Content = plainText(msg.Segments)
+	case filter.BLOCK:
+		if len(words.Find(msg.Content)) > 0 {
+			return fmt.Errorf(`unable to send message to lobby: '%v': the message contains a filtered word`, lobby.Name())
+		}
+	case filter.FLAG:
+		if matches := words.Find(msg.Content); len(matches) > 0 {
+			lobby.Notice(GROUP, MODERATORS,
+				Styled(HIGHLIGHT, fmt.Sprintf(`Flagged message from %v: `, sender.Name())),
+				Text(msg.Content),
+			)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"Palette/lobby/user"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//Traffic is a kind of message sent by a user that is rate limited separately from the others
+type Traffic int
+
+const (
+	TRAFFIC_CHAT Traffic = iota
+	TRAFFIC_DRAWING
+	TRAFFIC_COMMANDS //slash commands and requests for chat history
+	TRAFFIC_PRESENCE //cursor positions and other short-lived state
+)
+
+//Budget is the rate at which a user can send a kind of traffic. A user can send up to `Burst` messages
+//at once after which they regain the ability to send `Rate` messages per second, ie. a token bucket
+type Budget struct {
+	Rate  float64
+	Burst int
+}
+
+/*
+	Limits are the flood protection settings of a lobby.
+
+	Every message that goes over the budget of its kind of traffic is dropped. Chat messages and commands over the
+	budget also count as violations, which escalate: after `Warn` violations the user is warned, after `Mute`
+	violations they are muted for `MuteDuration` and after `Kick` violations they are removed from the lobby.
+	Moderators are notified of every mute and kick. Violations are forgiven once a user has gone `Forgive` without one.
+	A threshold of 0 disables the action. Drawing and presence are sent as often as a user moves their pointer, so
+	going over their budget is not a violation: the user would be kicked for drawing quickly on a fast display.
+*/
+type Limits struct {
+	Chat, Drawing, Commands, Presence Budget
+	Warn, Mute, Kick                  int
+	MuteDuration, Forgive             time.Duration
+}
+
+//DefaultLimits returns the flood protection settings used by a lobby unless the server chooses otherwise
+func DefaultLimits() Limits {
+	return Limits{
+		Chat:         Budget{Rate: 1, Burst: 5},
+		Drawing:      Budget{Rate: 60, Burst: 120},
+		Commands:     Budget{Rate: 0.5, Burst: 3},
+		Presence:     Budget{Rate: 30, Burst: 60},
+		Warn:         3,
+		Mute:         6,
+		Kick:         12,
+		MuteDuration: 30 * time.Second,
+		Forgive:      time.Minute,
+	}
+}
+
+//budget returns the budget of a kind of traffic
+func (limits Limits) budget(traffic Traffic) Budget {
+	switch traffic {
+	case TRAFFIC_DRAWING:
+		return limits.Drawing
+	case TRAFFIC_COMMANDS:
+		return limits.Commands
+	case TRAFFIC_PRESENCE:
+		return limits.Presence
+	}
+	return limits.Chat
+}
+
+//bucket is a token bucket for a single kind of traffic
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//take takes a token from a bucket after refilling it for the time that has passed since it was last used.
+//Returns false if the bucket is empty
+func (b *bucket) take(budget Budget, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = float64(budget.Burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * budget.Rate
+	}
+	if b.tokens > float64(budget.Burst) {
+		b.tokens = float64(budget.Burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+//limiter is the flood protection state of a single user
+type limiter struct {
+	buckets       [TRAFFIC_PRESENCE + 1]bucket
+	violations    int
+	lastViolation time.Time
+	mutedUntil    time.Time
+	sync.Mutex
+}
+
+//Limits is an accessor for a lobby's flood protection settings
+func (lobby *Lobby) Limits() Limits {
+	lobby.limitersLock.Lock()
+	defer lobby.limitersLock.Unlock()
+	return lobby.limits
+}
+
+//SetLimits is a mutator for a lobby's flood protection settings
+func (lobby *Lobby) SetLimits(limits Limits) {
+	lobby.limitersLock.Lock()
+	defer lobby.limitersLock.Unlock()
+	lobby.limits = limits
+}
+
+//limiter returns the flood protection state of a user, creating it if needed. The limiters have their own mutex so
+//that the drawing and presence of every user do not wait for the lobby. Callers must check that the user is a member
+//of the lobby first, as the limiter is only deleted once they leave, see `forgetLimiter()`. Internal use only!
+func (lobby *Lobby) limiter(usr *user.User) (*limiter, Limits) {
+	lobby.limitersLock.Lock()
+	defer lobby.limitersLock.Unlock()
+	l := lobby.limiters[usr]
+	if l == nil {
+		l = &limiter{}
+		lobby.limiters[usr] = l
+	}
+	return l, lobby.limits
+}
+
+//Allow takes a message of the given kind of traffic from a user's budget. Returns false if the user is over
+//their budget, in which case the message must be dropped and the violation is escalated, see `Limits`
+func (lobby *Lobby) Allow(usr *user.User, traffic Traffic) bool {
+	l, limits := lobby.limiter(usr)
+	now := time.Now()
+	l.Lock()
+	if l.buckets[traffic].take(limits.budget(traffic), now) {
+		l.Unlock()
+		return true
+	}
+	if traffic == TRAFFIC_DRAWING || traffic == TRAFFIC_PRESENCE { //only dropped, see `Limits`
+		l.Unlock()
+		return false
+	}
+	if now.Sub(l.lastViolation) > limits.Forgive {
+		l.violations = 0
+	}
+	l.violations++
+	l.lastViolation = now
+	violations := l.violations
+	if violations == limits.Mute {
+		l.mutedUntil = now.Add(limits.MuteDuration)
+	}
+	l.Unlock()
+	name := usr.Name()
+	switch {
+	case limits.Kick > 0 && violations == limits.Kick:
+		notify(usr, Event{`kicked`, `you have been removed from the lobby for flooding`})
+		if lobby.RemoveUser(name) == nil {
+			lobby.Notice(GROUP, MODERATORS, Styled(NEGATIVE, fmt.Sprintf(`%v was kicked for flooding`, name)))
+		}
+	case limits.Mute > 0 && violations == limits.Mute:
+		lobby.Notice(USER, name, Styled(NEGATIVE, fmt.Sprintf(`You have been muted for %v for flooding`, limits.MuteDuration)))
+		lobby.Notice(GROUP, MODERATORS, Styled(NEGATIVE, fmt.Sprintf(`%v was muted for %v for flooding`, name, limits.MuteDuration)))
+	case limits.Warn > 0 && violations == limits.Warn:
+		lobby.Notice(USER, name, Styled(NEGATIVE, `You are sending messages too quickly. Slow down or you will be muted`))
+	}
+	return false
+}
+
+//muted reports whether a user has been muted for flooding. Internal use only!
+func (lobby *Lobby) muted(usr *user.User) bool {
+	lobby.limitersLock.Lock()
+	l := lobby.limiters[usr]
+	lobby.limitersLock.Unlock()
+	if l == nil { //the user has never gone over their budget
+		return false
+	}
+	l.Lock()
+	defer l.Unlock()
+	return time.Now().Before(l.mutedUntil)
+}
+
+//forgetLimiter deletes the flood protection state of a user that has left the lobby. Internal use only!
+func (lobby *Lobby) forgetLimiter(usr *user.User) {
+	lobby.limitersLock.Lock()
+	defer lobby.limitersLock.Unlock()
+	delete(lobby.limiters, usr)
+}
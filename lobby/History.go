@@ -0,0 +1,113 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"Palette/lobby/user"
+	"encoding/json"
+	"fmt"
+)
+
+//HISTORY_PAGE_SIZE is the number of messages in a page of chat history unless a smaller page is requested
+const HISTORY_PAGE_SIZE = 50
+
+//Page is a page of a lobby's chat history with messages ordered from oldest to newest.
+//Every message ever sent in a lobby has an index, `Before` is the index of the first message of the page
+//and can be used to request the page before it. `Before` is 0 once no older messages are left
+type Page struct {
+	Messages []Message `json:"messages"`
+	Before   int       `json:"before"`
+}
+
+//history is a ring buffer that holds the most recent messages of a lobby. It is guarded by the lobby's mutex
+type history struct {
+	messages []Message
+	start    int //position of the oldest message in `messages`
+	count    int //number of messages in the buffer
+	total    int //number of messages ever added, the index of the next message
+}
+
+//newHistory is the constructor for a history that holds at most `size` messages
+func newHistory(size int) *history {
+	if size < 0 {
+		size = 0
+	}
+	return &history{messages: make([]Message, size)}
+}
+
+//add adds a message to the history, overwriting the oldest message if the history is full
+func (h *history) add(msg Message) {
+	h.total++
+	if len(h.messages) == 0 {
+		return
+	}
+	if h.count < len(h.messages) {
+		h.messages[(h.start+h.count)%len(h.messages)] = msg
+		h.count++
+		return
+	}
+	h.messages[h.start] = msg
+	h.start = (h.start + 1) % len(h.messages)
+}
+
+//find returns the message with the given ID, `nil` if it is not in the history
+func (h *history) find(id int) *Message {
+	for i := 0; i < h.count; i++ {
+		if msg := &h.messages[(h.start+i)%len(h.messages)]; msg.ID == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+//page returns up to `limit` of the messages that came before the message with the index `before`.
+//A `before` <= 0 or past the newest message returns the most recent messages
+func (h *history) page(before, limit int) Page {
+	if limit <= 0 || limit > HISTORY_PAGE_SIZE {
+		limit = HISTORY_PAGE_SIZE
+	}
+	if before <= 0 || before > h.total {
+		before = h.total
+	}
+	oldest := h.total - h.count //index of the oldest message still in the buffer
+	first := before - limit
+	if first < oldest {
+		first = oldest
+	}
+	if first > before { //everything before `before` has already been overwritten
+		first = before
+	}
+	page := Page{make([]Message, 0, before-first), first}
+	for i := first; i < before; i++ {
+		msg := h.messages[(h.start+i-oldest)%len(h.messages)]
+		if msg.Reactions != nil { //the counts can change once the lobby is unlocked
+			counts := make(map[string]int, len(msg.Reactions))
+			for emoji, count := range msg.Reactions {
+				counts[emoji] = count
+			}
+			msg.Reactions = counts
+		}
+		msg.reactors = nil
+		page.Messages = append(page.Messages, msg)
+	}
+	if first <= oldest || len(page.Messages) == 0 { //nothing older is left to request, ie. the rest was overwritten
+		page.Before = 0
+	}
+	return page
+}
+
+//History is an accessor for a page of a lobby's chat history, see `Page`
+func (lobby *Lobby) History(before, limit int) Page {
+	lobby.RLock()
+	defer lobby.RUnlock()
+	return lobby.history.page(before, limit)
+}
+
+//SendHistory sends a page of a lobby's chat history to a user over their `chat` channel in the form of `{"history": Page}`.
+//Returns an error if the user is not connected
+func (lobby *Lobby) SendHistory(usr *user.User, before, limit int) error {
+	bin, _ := json.Marshal(map[string]Page{`history`: lobby.History(before, limit)})
+	if e := usr.SendChat(bin); e != nil {
+		return fmt.Errorf(`unable to send chat history: %v`, e)
+	}
+	return nil
+}
@@ -2,7 +2,12 @@
 package lobby
 
 import (
+	"Palette/lobby/filter"
 	"Palette/lobby/user"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"sync"
@@ -13,40 +18,97 @@ import (
 	Lobby is a container that manages a collection of users.
 
 	Lobby utilizes a thread safe map that uses usernames as keys and uses pointers to `User` instances as the values.
-	Similar to `Manager`, upon creation, the constructor will start up the `userManager()` goroutine. This goroutine
-	will poll the users in the map and see if the user has exceeded the lobby's maximum timeout period and delete their
-	data from the lobby.
+	Every lobby is given a random ID upon creation that, unlike its name, never changes and is used to refer to the
+	lobby from outside of it. Similar to `Manager`, upon creation, the constructor will start up the `userManager()` goroutine. This goroutine
+	sleeps until a chat message arrives or the earliest deadline of a disconnected user passes, at which point the user
+	has exceeded the lobby's maximum timeout period and their data is deleted from the lobby.
+
+	A lobby holds at most `settings.Capacity` users. Users that join a full lobby are placed in a FIFO waiting queue and are
+	admitted in order as soon as a slot frees up. Once the last user leaves or `Close()` is called, the lobby starts to
+	drain: its context is cancelled, new users and messages are rejected and the `userManager()` goroutine exits.
 */
 type Lobby struct {
+	id             string
+	state          State
+	ctx            context.Context
+	cancel         context.CancelFunc
 	name, password string
 	users          map[string]*user.User
+	queue          []*user.User //users waiting for a slot in a full lobby, in order of arrival
 	host           *user.User
+	settings       Settings
 	chat           chan Message
+	history        *history
+	lastID         int //ID of the last message delivered
+	commands       *Registry
+	words          *filter.Filter          //the built-in and custom filtered words of `settings`
+	stages         []Stage                 //chat pipeline, see `Stage`
+	limits         Limits                  //guarded by `limitersLock` instead of the lobby's mutex
+	limiters       map[*user.User]*limiter //flood protection state of every member that has sent a message, guarded by `limitersLock`
+	limitersLock   sync.Mutex
+	strokes        []Stroke                  //whiteboard data in the order it was drawn, see `Lobby.Draw()`
+	voice          map[*user.User]VoiceState //voice states of the users that have changed theirs, see `Lobby.Voice()`
+	replays        map[*user.User]*replay    //replays of the whiteboard in progress, see `Lobby.Replay()`
+	recorder       Recorder                  //`nil` unless the lobby is being recorded, see `Lobby.OnRecord()`
+	startRecorder  func(*Lobby) (Recorder, error)
+	recordLock     sync.Mutex  //held while a recorder is started without the lobby locked, see `Lobby.ChangeSettings()`
 	shutdown       chan string //channel to signal the manager to delete, should only be accessed by manager
+	manager        *Manager    //manager that indexes this lobby, `nil` if it has not been added to one
 	maxTimeout     time.Duration
+	expiries       expiries //deadlines of disconnected users, guarded by `expiryLock` instead of the lobby's mutex
+	expiryLock     sync.Mutex
+	wake           chan struct{} //signals the `userManager()` goroutine to check the lobby's users
 	sync.RWMutex
 }
 
 // === Lobby Properties === //
 
 //Constructor for a lobby object, starts the newly created lobby's `userManager()` goroutine.
-//NOTE: `host` cannot be `nil`, this function will panic if so as it will initialize the map of users with `{host.Name(): host}`
-func New(name, password string, maxTimeout time.Duration, host *user.User) *Lobby {
+//The lobby keeps the last `historySize` chat messages for users that join or reconnect later.
+//NOTE: `host` cannot be `nil`, this function will panic if so as it will initialize the map of users with `{host.Name(): host}`.
+//It also panics if the system's secure random number generator fails
+func New(name, password string, settings Settings, maxTimeout time.Duration, historySize int, host *user.User) *Lobby {
+	id := make([]byte, 16)
+	if _, e := rand.Read(id); e != nil { //lobbies would share the same ID, the system cannot be trusted to generate secrets either
+		panic(fmt.Errorf(`unable to generate lobby ID: %v`, e))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	lobby := Lobby{
+		id:         hex.EncodeToString(id),
+		state:      CREATED,
+		ctx:        ctx,
+		cancel:     cancel,
 		name:       name,
 		password:   password,
 		users:      map[string]*user.User{host.Name(): host},
+		queue:      make([]*user.User, 0),
 		host:       host,
+		settings:   settings,
 		chat:       make(chan Message),
+		history:    newHistory(historySize),
+		commands:   NewRegistry(Commands),
+		words:      settings.words(),
+		stages:     []Stage{wordFilter, mentions},
+		limits:     DefaultLimits(),
+		limiters:   make(map[*user.User]*limiter),
+		voice:      make(map[*user.User]VoiceState),
+		replays:    make(map[*user.User]*replay),
 		maxTimeout: maxTimeout,
+		expiries:   make(expiries, 0),
+		wake:       make(chan struct{}, 1),
 		RWMutex:    sync.RWMutex{},
 	}
+	host.OnDisconnect(lobby.schedule)
+	lobby.schedule(host) //the host may have disconnected before the lobby was created
 	go lobby.userManager()
 	return &lobby
 }
 
 // Accessors (a pointer is used to prevent copying the struct)
 
+//ID is an accessor for a lobby's ID. It is immutable
+func (lobby *Lobby) ID() string { return lobby.id }
+
 //Name is an accessor for a lobby's name value
 func (lobby *Lobby) Name() string {
 	lobby.RLock()
@@ -76,16 +138,55 @@ func (lobby *Lobby) Size() int {
 	return len(lobby.users)
 }
 
-//Chat is an accessor for for a lobby's chat message channel. It is immutable
-func (lobby *Lobby) Chat() chan Message { return lobby.chat }
+//Capacity is an accessor for the maximum number of users a lobby can hold before new users are queued
+func (lobby *Lobby) Capacity() int {
+	lobby.RLock()
+	defer lobby.RUnlock()
+	return lobby.settings.Capacity
+}
+
+//Settings is an accessor for a copy of a lobby's settings
+func (lobby *Lobby) Settings() Settings {
+	lobby.RLock()
+	defer lobby.RUnlock()
+	settings := lobby.settings
+	settings.WordPacks = append([]string{}, settings.WordPacks...) //prevent modification of the lobby's word packs
+	settings.Terms = append([]string{}, settings.Terms...)
+	return settings
+}
+
+//Send queues a chat message to be broadcasted to every user in a lobby.
+//Returns an error if the lobby is shutting down
+func (lobby *Lobby) Send(msg Message) error {
+	if lobby.ctx.Err() == nil {
+		select {
+		case <-lobby.ctx.Done():
+		case lobby.chat <- msg:
+			return nil
+		}
+	}
+	return fmt.Errorf(`unable to send message to lobby: '%v': %v`, lobby.Name(), lobby.State())
+}
 
 // Mutators
 
-//SetName is a mutator for a lobby's name value
-func (lobby *Lobby) SetName(name string) {
+//SetName is a mutator for a lobby's name value. If the lobby has been added to a manager, the manager's index
+//of names is updated alongside it. Returns an error if the name is empty or in use by another lobby of the manager
+func (lobby *Lobby) SetName(name string) error {
+	lobby.RLock()
+	manager := lobby.manager
+	lobby.RUnlock()
+	if manager != nil {
+		return manager.rename(lobby, name)
+	}
 	lobby.Lock()
 	defer lobby.Unlock()
+	if name == `` {
+		return fmt.Errorf(`unable to rename '%v': the name cannot be empty`, lobby.name)
+	}
 	lobby.name = name
+	lobby.broadcast(Event{`name`, name})
+	return nil
 }
 
 //SetPassword is a mutator for a lobby's password value
@@ -95,6 +196,108 @@ func (lobby *Lobby) SetPassword(password string) {
 	lobby.password = password
 }
 
+//SetCapacity is a mutator for the maximum number of users of a lobby. Raising the capacity will immediately
+//admit users from the waiting queue, lowering it will not remove anyone that has already joined.
+//Returns an error if the capacity given is out of range
+func (lobby *Lobby) SetCapacity(capacity int) error {
+	lobby.Lock()
+	defer lobby.Unlock()
+	settings := lobby.settings
+	settings.Capacity = capacity
+	return lobby.setSettings(settings, nil)
+}
+
+//UpdateSettings applies a partial JSON update such as `{"rounds": 5}` on behalf of the user with the given name.
+//The update is only applied if the user is authorized and every resulting value is valid, in which case
+//the changed values are broadcasted to every member of the lobby. External use only!
+func (lobby *Lobby) UpdateSettings(name string, update []byte) error {
+	return lobby.ChangeSettings(name, func(settings *Settings) error {
+		decoder := json.NewDecoder(bytes.NewReader(update))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(settings)
+	})
+}
+
+//ChangeSettings applies a change to a copy of a lobby's settings on behalf of the user with the given name.
+//The change is only applied if the user is authorized, `change` does not return an error and every resulting
+//value is valid, in which case the changed values are broadcasted to every member of the lobby.
+//`change` may be called more than once, as a change that enables recording is applied again once the recorder has
+//been started without the lobby locked. External use only!
+func (lobby *Lobby) ChangeSettings(name string, change func(*Settings) error) error {
+	lobby.recordLock.Lock() //only one recorder is started at a time
+	defer lobby.recordLock.Unlock()
+	recorder, e := lobby.prepareRecorder(name, change)
+	if e != nil {
+		return fmt.Errorf(`unable to change settings of '%v': %v`, lobby.Name(), e)
+	}
+	lobby.Lock()
+	defer lobby.Unlock()
+	settings, e := lobby.changed(name, change) //the lobby may have changed while the recorder was started
+	if e == nil {
+		e = lobby.setSettings(settings, recorder)
+	}
+	if recorder != nil && lobby.recorder != recorder {
+		recorder.Close() //the change no longer enables recording
+	}
+	return e
+}
+
+//prepareRecorder starts a recorder if a change of settings enables recording, as starting one may wait for the disk.
+//The lobby must not be locked by the caller. Internal use only!
+func (lobby *Lobby) prepareRecorder(name string, change func(*Settings) error) (Recorder, error) {
+	lobby.RLock()
+	settings, e := lobby.changed(name, change)
+	start := lobby.startRecorder
+	enable := e == nil && settings.Record && !lobby.settings.Record && start != nil && settings.Validate() == nil
+	lobby.RUnlock()
+	if !enable {
+		return nil, nil
+	}
+	return start(lobby)
+}
+
+//changed returns a copy of a lobby's settings with a change applied on behalf of the user with the given name.
+//Returns an error if the user is not authorized or `change` fails. Internal use only!
+func (lobby *Lobby) changed(name string, change func(*Settings) error) (Settings, error) {
+	if !lobby.authorized(name) {
+		return Settings{}, fmt.Errorf(`'%v' is not allowed to change the settings of '%v'`, name, lobby.name)
+	}
+	settings := lobby.settings
+	settings.WordPacks = append([]string{}, settings.WordPacks...) //changes to the copy must not affect the current lists
+	settings.Terms = append([]string{}, settings.Terms...)
+	if e := change(&settings); e != nil {
+		return Settings{}, fmt.Errorf(`invalid settings for '%v': %v`, lobby.name, e)
+	}
+	return settings, nil
+}
+
+//setSettings validates and replaces the settings of a lobby and broadcasts the changes to its members. `recorder` is
+//installed if the settings enable recording, see `Lobby.ChangeSettings()`. Internal use only!
+func (lobby *Lobby) setSettings(settings Settings, recorder Recorder) error {
+	if e := settings.Validate(); e != nil {
+		return fmt.Errorf(`unable to change settings of '%v': %v`, lobby.name, e)
+	}
+	if settings.Record != lobby.settings.Record {
+		if e := lobby.record(settings.Record, recorder); e != nil {
+			return fmt.Errorf(`unable to change settings of '%v': %v`, lobby.name, e)
+		}
+	}
+	changes := settings.diff(lobby.settings)
+	lobby.settings = settings
+	lobby.words = settings.words()
+	if len(changes) == 0 {
+		return nil
+	}
+	lobby.broadcast(Event{`settings`, changes})
+	lobby.admit() //the capacity may have been raised
+	return nil
+}
+
+//authorized reports whether the user with the given name may reconfigure a lobby. Internal use only!
+func (lobby *Lobby) authorized(name string) bool {
+	return lobby.host != nil && lobby.host.Name() == name
+}
+
 //SetHost is a mutator for the host of a lobby given the new host's username.
 //Returns an error if a user with the given username has not joined the lobby
 func (lobby *Lobby) SetHost(name string) error {
@@ -119,12 +322,28 @@ func (lobby *Lobby) GetUser(name string) *user.User {
 	return lobby.users[name]
 }
 
-//AddUser adds a pointer to a user to the `users` map of a lobby.
+//Waiting is an accessor for a user in a lobby's waiting queue given their username.
+//Returns the user and their position in the queue starting at 1 or (nil, 0) if they are not queued. External use only!
+func (lobby *Lobby) Waiting(name string) (*user.User, int) {
+	lobby.RLock()
+	defer lobby.RUnlock()
+	for i, u := range lobby.queue {
+		if u.Name() == name {
+			return u, i + 1
+		}
+	}
+	return nil, 0
+}
+
+//AddUser adds a pointer to a user to the `users` map of a lobby or to the waiting queue if the lobby is full.
 //If the given user has a name that is not unqiue relative to the lobby, it will be adjusted.
-//Returns an error if the pointer given is `nil`. External use only!
+//Returns an error if the pointer given is `nil` or the lobby is shutting down. External use only!
 func (lobby *Lobby) AddUser(user *user.User) error {
 	lobby.Lock()
 	defer lobby.Unlock()
+	if e := lobby.open(); e != nil {
+		return e
+	}
 	return lobby.addUser(user)
 }
 
@@ -136,18 +355,59 @@ func (lobby *Lobby) addUser(user *user.User) error {
 	name := user.Name()
 	newName := name
 	//i+1 bc adjusted names will start at 'name-1' instead of 'name-0'
-	for i := 0; lobby.users[newName] != nil; i++ {
+	for i := 0; lobby.nameTaken(newName); i++ {
 		newName = fmt.Sprintf(`%v-%v`, name, i+1)
 	}
 	if newName != name { //don't wait for mutex release if we don't have to
 		user.SetName(newName)
 		name = newName
 	}
+	user.OnDisconnect(lobby.schedule)
+	lobby.schedule(user) //the user may have disconnected before joining
+	if len(lobby.users) >= lobby.settings.Capacity {
+		lobby.queue = append(lobby.queue, user)
+		notify(user, Event{`queue`, len(lobby.queue)})
+		return nil
+	}
 	lobby.users[name] = user
 	// log.Printf(`[%v] '%v' has joined.`, lobby.name, name)
 	return nil
 }
 
+//nameTaken reports whether a name is in use by a user that has joined or is waiting to join a lobby. Internal use only!
+func (lobby *Lobby) nameTaken(name string) bool {
+	if lobby.users[name] != nil {
+		return true
+	}
+	for _, u := range lobby.queue {
+		if u.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+//admit moves users from the front of the waiting queue into the lobby while there are free slots
+//and notifies the remaining users of their new position. Internal use only!
+func (lobby *Lobby) admit() {
+	admitted := 0
+	for ; admitted < len(lobby.queue) && len(lobby.users) < lobby.settings.Capacity; admitted++ {
+		u := lobby.queue[admitted]
+		lobby.users[u.Name()] = u
+		if lobby.host == nil { //the lobby emptied out while people were still waiting
+			lobby.host = u
+		}
+		notify(u, Event{`admitted`, lobby.name})
+	}
+	if admitted == 0 {
+		return
+	}
+	lobby.queue = lobby.queue[admitted:]
+	for i, u := range lobby.queue {
+		notify(u, Event{`queue`, i + 1})
+	}
+}
+
 //RemoveUser removes a pointer to user data to the `users` map of a lobby.
 //Returns an error if a user with the given name is not found in the lobby. External Use only!
 func (lobby *Lobby) RemoveUser(name string) error {
@@ -156,16 +416,29 @@ func (lobby *Lobby) RemoveUser(name string) error {
 	return lobby.removeUser(name)
 }
 
-//removeUser is the mutex free version of RemoveUser(). Internal use only!
+//removeUser is the mutex free version of RemoveUser(). Users removed from the waiting queue
+//are handled by dequeue(). A freed slot is given to the next user in the queue. Internal use only!
 func (lobby *Lobby) removeUser(name string) error {
 	user := lobby.users[name]
 	if user == nil {
+		if lobby.dequeue(name) {
+			return nil
+		}
 		return fmt.Errorf(
 			`unable to delete user: '%v' from lobby: '%v'. '%v' has not joined this lobby`,
 			name, lobby.name, name,
 		)
 	}
 	delete(lobby.users, name)
+	lobby.forgetLimiter(user)
+	delete(lobby.voice, user)
+	if replay := lobby.replays[user]; replay != nil {
+		replay.cancel()
+		delete(lobby.replays, user)
+	}
+	lobby.history.forget(name)
+	user.OnDisconnect(nil)
+	lobby.signal() //the lobby may be empty now
 	// log.Printf(`[%v] Player data for '%v' was deleted.`, lobby.name, name)
 	if user == lobby.host {
 		for _, u := range lobby.users {
@@ -177,46 +450,81 @@ func (lobby *Lobby) removeUser(name string) error {
 			lobby.host = nil
 		}
 	}
+	lobby.admit()
 	return nil
 }
 
-//Message represents a chat message to be broadcasted to every user or a specific user in a lobby
-type Message struct {
-	Sender  string `json:"sender"`
-	Content string `json:"content"`
-	Time    string `json:"time"`
+//dequeue removes a user from the waiting queue given their name and notifies everyone behind them of their new position.
+//Returns false if the user is not queued. Internal use only!
+func (lobby *Lobby) dequeue(name string) bool {
+	for i, u := range lobby.queue {
+		if u.Name() != name {
+			continue
+		}
+		lobby.queue = append(lobby.queue[:i], lobby.queue[i+1:]...)
+		u.OnDisconnect(nil)
+		lobby.forgetLimiter(u)
+		for ; i < len(lobby.queue); i++ {
+			notify(lobby.queue[i], Event{`queue`, i + 1})
+		}
+		return true
+	}
+	return false
+}
+
+//Event represents a lobby event such as a change in a user's queue position, to be sent to a specific user
+type Event struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+//notify sends an event to a user over their `events` channel. Users that are not connected are skipped
+func notify(user *user.User, event Event) {
+	bin, _ := json.Marshal(event)
+	user.SendEvent(bin)
+}
+
+//broadcast sends an event to every member of a lobby. Internal use only!
+func (lobby *Lobby) broadcast(event Event) {
+	for _, user := range lobby.users {
+		notify(user, event)
+	}
 }
 
 //userManager is a goroutine that handles distributing data to users and user data deletion.
-//If the lobby is empty, this goroutine will shutdown and signal the manager to delete it
+//Between chat messages, it sleeps until it is signaled or the next deadline of a disconnected user has passed.
+//If the lobby is empty, the lobby is closed. Once the lobby's context is cancelled, this goroutine will
+//finish the shutdown of the lobby and exit
 func (lobby *Lobby) userManager() {
+	timer := time.NewTimer(0) //check the lobby once upon creation
+	defer timer.Stop()
 	for {
 		select {
-		case msg, open := <-lobby.chat:
-			if !open {
-				return
-			}
-			bin, _ := json.Marshal(msg)
+		case <-lobby.ctx.Done():
+			lobby.finish()
+			return
+		case msg := <-lobby.chat:
 			lobby.Lock()
-			for _, user := range lobby.users {
-				chat := user.Channel(`chat`)
-				if chat != nil { //skip user if they are trying to reconnect
-					chat.SendText(string(bin))
-				}
-			}
+			lobby.deliver(msg)
 			lobby.Unlock()
-		default: //delete old users after lobby.maxTimeout
-			lobby.Lock()
-			for _, User := range lobby.users {
-				if User.TimeDisconnect() != user.NIL_TIME && time.Since(User.TimeDisconnect()) >= lobby.maxTimeout {
-					lobby.removeUser(User.Name())
-				}
-			}
-			if len(lobby.users) == 0 {
-				close(lobby.chat)            //shutdown this goroutine
-				lobby.shutdown <- lobby.name //signal the manager to delete this lobby
+			continue
+		case <-lobby.wake:
+		case <-timer.C:
+		}
+		lobby.Lock()
+		next := lobby.expire() //delete old users after lobby.maxTimeout
+		if len(lobby.users) == 0 {
+			lobby.close() //the next iteration will finish the shutdown
+		}
+		lobby.Unlock()
+		if !timer.Stop() { //drain the timer if it fired before it could be stopped
+			select {
+			case <-timer.C:
+			default:
 			}
-			lobby.Unlock()
+		}
+		if next != user.NIL_TIME {
+			timer.Reset(time.Until(next))
 		}
 	}
 }
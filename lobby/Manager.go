@@ -2,6 +2,7 @@
 package lobby
 
 import (
+	"fmt"
 	"log"
 	"sync"
 )
@@ -9,12 +10,14 @@ import (
 /*
 	Manager is a container that manages a collection of lobbies.
 
-	Manager utilizes a thread safe map that uses lobby names as keys and uses pointers to `Lobby` instances as the values.
-	Upon creation, the constructor will start up the `cleanup()` goroutine that will handle signals to delete a lobby given
-	its name; similar to an interrupt.
+	Manager utilizes a thread safe map that uses lobby IDs as keys and uses pointers to `Lobby` instances as the values.
+	As the name of a lobby can change, a second map is kept as an index of lobby names to IDs which is only updated
+	alongside the name of the lobby itself. Upon creation, the constructor will start up the `cleanup()` goroutine that
+	will handle signals to delete a lobby given its ID; similar to an interrupt.
 */
 type Manager struct {
 	lobbies  map[string]*Lobby
+	names    map[string]string //lobby name -> lobby ID
 	shutdown chan string
 	sync.RWMutex
 }
@@ -23,6 +26,7 @@ type Manager struct {
 func NewManager() *Manager {
 	manager := Manager{
 		lobbies:  make(map[string]*Lobby),
+		names:    make(map[string]string),
 		shutdown: make(chan string),
 		RWMutex:  sync.RWMutex{},
 	}
@@ -31,32 +35,81 @@ func NewManager() *Manager {
 }
 
 //cleanup is to be used as a separate goroutine. It handles a manager's `shutdown` channel
-//and will block until it is signaled with the name of a lobby to delete.
+//and will block until it is signaled with the ID of a lobby to delete.
 func (manager *Manager) cleanup() {
 	for {
-		lobbyName, open := <-manager.shutdown
+		id, open := <-manager.shutdown
 		if !open {
 			return
 		}
 		manager.Lock()
-		delete(manager.lobbies, lobbyName)
+		lobby := manager.lobbies[id]
+		if lobby != nil {
+			delete(manager.names, lobby.Name())
+			delete(manager.lobbies, id)
+		}
 		manager.Unlock()
-		log.Printf(`[Manager] Lobby: '%v' has been deleted`, lobbyName)
+		if lobby != nil {
+			log.Printf(`[Manager] Lobby: '%v' (%v) has been deleted`, lobby.Name(), id)
+		}
 	}
 }
 
-//AddLobby adds a pointer to a lobby to a manager's `lobbies` map
-func (manager *Manager) AddLobby(lobby *Lobby) {
+//AddLobby adds a pointer to a lobby to a manager's `lobbies` map and activates it.
+//Returns an error if a lobby with the same name already exists or the lobby is not newly created
+func (manager *Manager) AddLobby(lobby *Lobby) error {
 	manager.Lock()
 	defer manager.Unlock()
-	manager.lobbies[lobby.Name()] = lobby
+	lobby.Lock()
+	defer lobby.Unlock()
+	name := lobby.name
+	if lobby.state != CREATED {
+		return fmt.Errorf(`unable to add lobby: '%v' is %v`, name, lobby.state)
+	}
+	if manager.names[name] != `` {
+		return fmt.Errorf(`unable to add lobby: '%v' already exists`, name)
+	}
+	manager.lobbies[lobby.id] = lobby
+	manager.names[name] = lobby.id
 	lobby.shutdown = manager.shutdown
-	log.Printf(`[Manager] Lobby: '%v' has been created by '%v'`, lobby.Name(), lobby.Host().Name())
+	lobby.manager = manager
+	lobby.state = ACTIVE
+	if lobby.host != nil {
+		log.Printf(`[Manager] Lobby: '%v' (%v) has been created by '%v'`, name, lobby.id, lobby.host.Name())
+	}
+	return nil
 }
 
-//GetLobby is an accessor for a lobby in a manager's `lobbies` map given a name
-func (manager *Manager) GetLobby(name string) *Lobby {
+//GetLobby is an accessor for a lobby in a manager's `lobbies` map given its ID
+func (manager *Manager) GetLobby(id string) *Lobby {
 	manager.RLock()
 	defer manager.RUnlock()
-	return manager.lobbies[name]
+	return manager.lobbies[id]
+}
+
+//FindLobby is an accessor for a lobby in a manager's `lobbies` map given its current name
+func (manager *Manager) FindLobby(name string) *Lobby {
+	manager.RLock()
+	defer manager.RUnlock()
+	return manager.lobbies[manager.names[name]]
+}
+
+//rename changes the name of a lobby and the manager's index of names at the same time.
+//Returns an error if the name is empty or in use by another lobby. Internal use only!
+func (manager *Manager) rename(lobby *Lobby, name string) error {
+	manager.Lock()
+	defer manager.Unlock()
+	lobby.Lock()
+	defer lobby.Unlock()
+	if name == `` {
+		return fmt.Errorf(`unable to rename '%v': the name cannot be empty`, lobby.name)
+	}
+	if id := manager.names[name]; id != `` && id != lobby.id {
+		return fmt.Errorf(`unable to rename '%v': '%v' already exists`, lobby.name, name)
+	}
+	delete(manager.names, lobby.name)
+	manager.names[name] = lobby.id
+	lobby.name = name
+	lobby.broadcast(Event{`name`, name})
+	return nil
 }
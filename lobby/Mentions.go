@@ -0,0 +1,118 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"Palette/lobby/user"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//Mention is the data of the `mention` event sent to a user that is mentioned in a chat message
+type Mention struct {
+	ID     int    `json:"id"` //ID of the message, see `Message.ID`
+	Sender string `json:"sender"`
+}
+
+//mentions is the stage of the chat pipeline that turns every `@name` of a message into a segment that mentions the
+//user with that name, see `Segment.Mention`. Names are resolved against the users that are currently in the lobby, the
+//longest name wins so that `@bob-1` mentions `bob-1` rather than `bob`. Names of users that are not in the lobby are
+//left as plain text. It is the second stage of every lobby
+func mentions(lobby *Lobby, sender *user.User, msg *Message) error {
+	if !strings.Contains(msg.Content, `@`) {
+		return nil
+	}
+	lobby.RLock()
+	names := make([]string, 0, len(lobby.users))
+	for name := range lobby.users {
+		names = append(names, name)
+	}
+	lobby.RUnlock()
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	segments := make([]Segment, 0, len(msg.Segments))
+	for _, segment := range msg.Segments {
+		if segment.Style != PLAIN || segment.Mention != `` {
+			segments = append(segments, segment)
+			continue
+		}
+		segments = append(segments, mention(segment.Text, names)...)
+	}
+	msg.Segments = segments
+	return nil
+}
+
+//mention splits plain text into plain segments and segments that mention one of the given names,
+//which must be sorted from longest to shortest. Internal use only!
+func mention(text string, names []string) []Segment {
+	segments := make([]Segment, 0, 1)
+	plain := 0 //start of the text that has not been added to a segment yet
+	for i := 0; i < len(text); i++ {
+		if text[i] != '@' {
+			continue
+		}
+		if before, _ := utf8.DecodeLastRuneInString(text[:i]); i > 0 && !unicode.IsSpace(before) {
+			continue //ie. an email address
+		}
+		for _, name := range names {
+			end := i + 1 + len(name)
+			if end > len(text) || text[i+1:end] != name {
+				continue
+			}
+			if after, _ := utf8.DecodeRuneInString(text[end:]); end < len(text) && (unicode.IsLetter(after) || unicode.IsDigit(after) || after == '-' || after == '_') {
+				continue //`@bob` must not mention `bo`
+			}
+			if plain < i {
+				segments = append(segments, Text(text[plain:i]))
+			}
+			segments = append(segments, Segment{Text: text[i:end], Mention: name})
+			plain, i = end, end-1
+			break
+		}
+	}
+	if plain < len(text) {
+		segments = append(segments, Text(text[plain:]))
+	}
+	return segments
+}
+
+//notifyMentions sends a `mention` event to every user that is mentioned by a message and is part of its audience,
+//see `Mention`. Users are not notified when they mention themselves. Internal use only!
+func (lobby *Lobby) notifyMentions(msg Message) {
+	notified := make(map[string]bool)
+	for _, segment := range msg.Segments {
+		usr := lobby.users[segment.Mention]
+		if usr == nil || notified[segment.Mention] || segment.Mention == msg.Sender || !lobby.receives(usr, msg) {
+			continue
+		}
+		notified[segment.Mention] = true
+		notify(usr, Event{`mention`, Mention{msg.ID, msg.Sender}})
+	}
+}
+
+//forget turns every mention of a user in the history back into plain text once they have left and drops their
+//authorship and reactions, so that a user that joins later with the same name is not mistaken for them
+func (h *history) forget(name string) {
+	for i := 0; i < h.count; i++ {
+		msg := &h.messages[(h.start+i)%len(h.messages)]
+		if msg.Sender == name && !msg.System {
+			msg.departed = true
+		}
+		for _, reactors := range msg.reactors {
+			delete(reactors, name) //the counts still include their reactions
+		}
+		for j := range msg.Segments {
+			if msg.Segments[j].Mention != name {
+				continue
+			}
+			segments := append([]Segment{}, msg.Segments...) //pages of the history may still be using the old segments
+			for k := j; k < len(segments); k++ {
+				if segments[k].Mention == name {
+					segments[k].Mention = ``
+				}
+			}
+			msg.Segments = segments
+			break
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"Palette/lobby/user"
+	"encoding/json"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+//Limits of the reactions to a chat message
+const (
+	MAX_REACTIONS    = 20 //number of different emoji a message can be reacted with
+	MAX_EMOJI_LENGTH = 8  //number of runes in an emoji, which can be made up of several runes such as 👍🏽 or 👨‍👩‍👧
+)
+
+//Reactions is the update sent to every user when the reactions to a message change,
+//in the form of `{"reactions": {"id": 42, "counts": {"👍": 3}}}`
+type Reactions struct {
+	ID     int            `json:"id"`
+	Counts map[string]int `json:"counts"`
+}
+
+//React toggles the reaction of a user with an emoji to a message of a lobby's chat history and broadcasts
+//the new counts to every member. Only messages in the history can be reacted to as every user can see them.
+//Returns an error if the message does not exist, has been deleted or the emoji is invalid
+func (lobby *Lobby) React(sender *user.User, id int, emoji string) error {
+	if !validEmoji(emoji) {
+		return fmt.Errorf(`unable to react to message %v: '%v' is not an emoji`, id, emoji)
+	}
+	name := sender.Name()
+	lobby.Lock()
+	defer lobby.Unlock()
+	msg := lobby.history.find(id)
+	if msg == nil || msg.Deleted {
+		return fmt.Errorf(`unable to react to message %v: the message does not exist`, id)
+	}
+	if msg.reactors == nil {
+		msg.Reactions, msg.reactors = make(map[string]int), make(map[string]map[string]bool)
+	}
+	reactors := msg.reactors[emoji]
+	switch {
+	case reactors[name]:
+		delete(reactors, name)
+		msg.Reactions[emoji]--
+		if msg.Reactions[emoji] == 0 {
+			delete(msg.Reactions, emoji)
+			delete(msg.reactors, emoji)
+		}
+	case reactors == nil && len(msg.reactors) >= MAX_REACTIONS:
+		return fmt.Errorf(`unable to react to message %v: a message can have at most %v different reactions`, id, MAX_REACTIONS)
+	default:
+		if reactors == nil {
+			reactors = make(map[string]bool)
+			msg.reactors[emoji] = reactors
+		}
+		reactors[name] = true
+		msg.Reactions[emoji]++
+	}
+	lobby.broadcastChat(map[string]Reactions{`reactions`: {id, msg.Reactions}})
+	return nil
+}
+
+//Delete removes the content and reactions of a message of a lobby's chat history on behalf of a user and tells every
+//member to remove it, in the form of `{"deleted": 42}`. Returns an error if the message does not exist or
+//the user is neither its author nor a moderator. Once the author has left, only a moderator can delete it
+func (lobby *Lobby) Delete(sender *user.User, id int) error {
+	name := sender.Name()
+	lobby.Lock()
+	defer lobby.Unlock()
+	msg := lobby.history.find(id)
+	if msg == nil || msg.Deleted {
+		return fmt.Errorf(`unable to delete message %v: the message does not exist`, id)
+	}
+	if (msg.Sender != name || msg.departed) && !lobby.inGroup(sender, MODERATORS) {
+		return fmt.Errorf(`unable to delete message %v: only its author or a moderator can delete it`, id)
+	}
+	*msg = Message{
+		ID:       msg.ID,
+		Sender:   msg.Sender,
+		Segments: []Segment{},
+		Time:     msg.Time,
+		Audience: msg.Audience,
+		System:   msg.System,
+		Deleted:  true,
+	}
+	lobby.broadcastChat(map[string]int{`deleted`: id})
+	return nil
+}
+
+//broadcastChat sends an update about the chat to every member of a lobby over their `chat` channel. Internal use only!
+func (lobby *Lobby) broadcastChat(update interface{}) {
+	bin, _ := json.Marshal(update)
+	if lobby.recorder != nil {
+		lobby.recorder.Chat(bin)
+	}
+	for _, usr := range lobby.users {
+		usr.SendChat(bin) //users that are trying to reconnect are skipped
+	}
+}
+
+//validEmoji reports whether a reaction is a single emoji, that is a short sequence of symbols without any
+//letters, digits or whitespace. Internal use only!
+func validEmoji(emoji string) bool {
+	if emoji == `` || utf8.RuneCountInString(emoji) > MAX_EMOJI_LENGTH {
+		return false
+	}
+	symbol := false
+	for _, r := range emoji {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), unicode.IsSpace(r), unicode.IsControl(r):
+			return false
+		case unicode.Is(unicode.So, r):
+			symbol = true
+		}
+	}
+	return symbol
+}
@@ -0,0 +1,49 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"fmt"
+)
+
+//Recorder records the strokes and chat of a lobby while recording is enabled in its settings, see `Lobby.OnRecord()`
+type Recorder interface {
+	Stroke(name string, data []byte) //whiteboard data drawn by a user
+	Chat(update []byte)              //JSON sent over the `chat` channel of every user
+	Close() error
+}
+
+//OnRecord sets the function that starts a recorder whenever recording is enabled in a lobby's settings, `nil`
+//makes recording unavailable. The function is called without the lobby locked, one recorder at a time, and must not
+//change the lobby
+func (lobby *Lobby) OnRecord(start func(*Lobby) (Recorder, error)) {
+	lobby.Lock()
+	defer lobby.Unlock()
+	lobby.startRecorder = start
+}
+
+//Recording reports whether a lobby is being recorded
+func (lobby *Lobby) Recording() bool {
+	lobby.RLock()
+	defer lobby.RUnlock()
+	return lobby.recorder != nil
+}
+
+//record installs a recorder that was started by `Lobby.ChangeSettings()` or stops the recorder of a lobby. The strokes
+//already on the whiteboard are recorded first so that the recording is complete on its own. Internal use only!
+func (lobby *Lobby) record(enabled bool, recorder Recorder) error {
+	switch {
+	case enabled && lobby.recorder == nil:
+		if recorder == nil {
+			return fmt.Errorf(`recording is not available on this server`)
+		}
+		for _, stroke := range lobby.strokes {
+			recorder.Stroke(stroke.Sender, stroke.Data)
+		}
+		lobby.recorder = recorder
+	case !enabled && lobby.recorder != nil:
+		e := lobby.recorder.Close()
+		lobby.recorder = nil
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"Palette/lobby/user"
+	"context"
+	"fmt"
+	"time"
+)
+
+//Speeds at which a user can replay the whiteboard of a lobby, see `Lobby.Replay()`
+const (
+	MIN_REPLAY_SPEED = 1
+	MAX_REPLAY_SPEED = 16
+)
+
+//replay is a replay of the whiteboard in progress for a single user
+type replay struct {
+	cancel context.CancelFunc //stops the replay without sending the remaining strokes, ie. once the user leaves
+	skip   chan struct{}      //closed to send the remaining strokes at once, see `Lobby.Replay()`
+}
+
+/*
+	Replay redraws the whiteboard of a user by sending them every stroke of the lobby over their `strokes` channel with
+	the time between strokes divided by `speed`, so that the drawing unfolds as it was drawn but faster.
+
+	The user is notified with `{"type": "replay", "data": {"state": "started", "speed": n, "strokes": n}}` before the
+	first stroke and `{"type": "replay", "data": {"state": "finished"}}` after the last one, so that their client can
+	clear its whiteboard beforehand. Strokes drawn during a replay are relayed to the user as usual but are not part of
+	it. Requesting another replay replaces the one in progress and a speed of 0 stops it, in which case the remaining
+	strokes are sent at once so that the whiteboard of the user is complete. Returns an error if the user has not joined
+	the lobby or the speed is not between `MIN_REPLAY_SPEED` and `MAX_REPLAY_SPEED`
+*/
+func (lobby *Lobby) Replay(usr *user.User, speed int) error {
+	lobby.Lock()
+	defer lobby.Unlock()
+	name := usr.Name()
+	switch {
+	case lobby.users[name] != usr:
+		return fmt.Errorf(`unable to replay whiteboard of lobby: '%v': '%v' has not joined this lobby`, lobby.name, name)
+	case speed != 0 && (speed < MIN_REPLAY_SPEED || speed > MAX_REPLAY_SPEED):
+		return fmt.Errorf(`unable to replay whiteboard of lobby: '%v': speed must be between %vx and %vx`, lobby.name, MIN_REPLAY_SPEED, MAX_REPLAY_SPEED)
+	}
+	if current := lobby.replays[usr]; current != nil {
+		delete(lobby.replays, usr)
+		if speed == 0 {
+			close(current.skip)
+			return nil
+		}
+		current.cancel()
+	}
+	if speed == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(lobby.ctx)
+	r := &replay{cancel, make(chan struct{})}
+	lobby.replays[usr] = r
+	go lobby.replay(ctx, usr, r, lobby.strokes, speed)
+	return nil
+}
+
+//replay is a goroutine that sends the strokes of a replay to a user on time, see `Lobby.Replay()`. Internal use only!
+func (lobby *Lobby) replay(ctx context.Context, usr *user.User, r *replay, strokes []Stroke, speed int) {
+	defer func() {
+		r.cancel()
+		lobby.Lock()
+		if lobby.replays[usr] == r {
+			delete(lobby.replays, usr)
+		}
+		lobby.Unlock()
+	}()
+	notify(usr, Event{`replay`, map[string]interface{}{`state`: `started`, `speed`: speed, `strokes`: len(strokes)}})
+	start := time.Now()
+	skipped := false
+	for _, stroke := range strokes {
+		if wait := time.Until(start.Add(stroke.Time.Sub(strokes[0].Time) / time.Duration(speed))); wait > 0 && !skipped {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+			case <-r.skip:
+				skipped = true
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+		if ctx.Err() != nil || usr.SendStroke(stroke.Data) != nil { //the user left or is trying to reconnect
+			return
+		}
+	}
+	notify(usr, Event{`replay`, map[string]interface{}{`state`: `finished`}})
+}
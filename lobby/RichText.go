@@ -0,0 +1,86 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"html"
+	"strings"
+)
+
+//Style tokens of a segment of rich text. Clients map each token to their own presentation,
+//a token is never markup
+const (
+	PLAIN     = ``
+	BOLD      = `bold`
+	ITALIC    = `italic`
+	CODE      = `code`
+	HIGHLIGHT = `highlight`
+	POSITIVE  = `positive` //ie. a correct guess or a user joining
+	NEGATIVE  = `negative` //ie. an error or a user leaving
+)
+
+var styles = map[string]bool{PLAIN: true, BOLD: true, ITALIC: true, CODE: true, HIGHLIGHT: true, POSITIVE: true, NEGATIVE: true}
+
+/*
+	Segment is a piece of the rich text content of a chat message.
+
+	Chat is never sent as markup. Instead, the content of a message is a list of segments where the text of every
+	segment is plain text that clients must display as-is, along with a style token and the name of the user it
+	mentions, if any. Users can only send plain segments, styles are reserved for messages from the server.
+*/
+type Segment struct {
+	Text    string `json:"text"`
+	Style   string `json:"style,omitempty"`
+	Mention string `json:"mention,omitempty"` //name of the user mentioned by this segment
+}
+
+//Text is a constructor for a plain segment of text
+func Text(text string) Segment { return Segment{Text: text} }
+
+//Styled is a constructor for a segment of text with a style token. Unknown style tokens are dropped
+func Styled(style, text string) Segment {
+	if !styles[style] {
+		style = PLAIN
+	}
+	return Segment{Text: text, Style: style}
+}
+
+//plainText returns the text of a list of segments without any styling
+func plainText(segments []Segment) string {
+	text := strings.Builder{}
+	for _, segment := range segments {
+		text.WriteString(segment.Text)
+	}
+	return text.String()
+}
+
+//HTML renders the segments of a message as HTML for clients that display chat as markup, such as exported logs.
+//The text of every segment and every mentioned name is escaped and only the classes of known style tokens are
+//ever added, so nothing that came from a user can be interpreted as markup
+func (msg Message) HTML() string {
+	rendered := strings.Builder{}
+	if msg.System {
+		rendered.WriteString(`<span class="system">`)
+	}
+	for _, segment := range msg.Segments {
+		classes := make([]string, 0, 2)
+		if styles[segment.Style] && segment.Style != PLAIN {
+			classes = append(classes, segment.Style)
+		}
+		if segment.Mention != `` {
+			classes = append(classes, `mention`)
+		}
+		if len(classes) == 0 {
+			rendered.WriteString(html.EscapeString(segment.Text))
+			continue
+		}
+		rendered.WriteString(`<span class="` + strings.Join(classes, ` `) + `"`)
+		if segment.Mention != `` {
+			rendered.WriteString(` data-user="` + html.EscapeString(segment.Mention) + `"`)
+		}
+		rendered.WriteString(`>` + html.EscapeString(segment.Text) + `</span>`)
+	}
+	if msg.System {
+		rendered.WriteString(`</span>`)
+	}
+	return rendered.String()
+}
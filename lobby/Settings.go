@@ -0,0 +1,123 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"Palette/lobby/filter"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+)
+
+//Limits for the values of a lobby's settings
+const (
+	MIN_DURATION, MAX_DURATION = 30, 180 //seconds
+	MIN_ROUNDS, MAX_ROUNDS     = 1, 10
+	MIN_CAPACITY, MAX_CAPACITY = 1, 64
+	MAX_WORD_PACKS             = 16
+	MAX_FILTER_TERMS           = 64
+)
+
+var (
+	modes       = map[string]bool{`whiteboard`: true, `pictionary`: true}
+	permissions = map[string]bool{`host`: true, `artist`: true, `everyone`: true} //who is allowed to draw
+	language    = regexp.MustCompile(`^[a-z]{2}$`)                                //ISO 639-1 language code
+)
+
+/*
+	Settings is the configuration of a lobby.
+
+	Settings are only changed as a whole by `Lobby.UpdateSettings()` so that every member of a lobby always sees a
+	consistent, validated configuration. Only the fields that were changed are broadcasted to the lobby.
+*/
+type Settings struct {
+	Mode      string   `json:"mode"`
+	Duration  int      `json:"duration"` //round duration in seconds
+	Rounds    int      `json:"rounds"`
+	Capacity  int      `json:"capacity"`
+	Public    bool     `json:"public"` //whether or not the lobby can be discovered by users outside of it
+	Language  string   `json:"language"`
+	WordPacks []string `json:"wordPacks"`
+	Drawing   string   `json:"drawing"` //drawing permissions: `host`, `artist` or `everyone`
+	Filter    string   `json:"filter"`  //action taken on chat messages with filtered words, see `filter.Actions`
+	Terms     []string `json:"terms"`   //words filtered in addition to the built-in list, see `filter.Default`
+	Voice     bool     `json:"voice"`   //whether the voice of users is forwarded to the lobby, see `Lobby.Audible()`
+	Record    bool     `json:"record"`  //whether the lobby is being recorded, see `Lobby.OnRecord()`
+}
+
+//DefaultSettings returns the settings used by a lobby unless the host chooses otherwise
+func DefaultSettings() Settings {
+	return Settings{
+		Mode:      `whiteboard`,
+		Duration:  80,
+		Rounds:    3,
+		Capacity:  12,
+		Public:    false,
+		Language:  `en`,
+		WordPacks: []string{},
+		Drawing:   `host`,
+		Filter:    filter.MASK,
+		Terms:     []string{},
+		Voice:     false,
+		Record:    false,
+	}
+}
+
+//Validate checks every value of a lobby's settings and returns an error describing the first invalid value
+func (settings Settings) Validate() error {
+	switch {
+	case !modes[settings.Mode]:
+		return fmt.Errorf(`invalid mode: '%v'`, settings.Mode)
+	case settings.Duration < MIN_DURATION || settings.Duration > MAX_DURATION:
+		return fmt.Errorf(`invalid duration: %v, must be between %v and %v seconds`, settings.Duration, MIN_DURATION, MAX_DURATION)
+	case settings.Rounds < MIN_ROUNDS || settings.Rounds > MAX_ROUNDS:
+		return fmt.Errorf(`invalid number of rounds: %v, must be between %v and %v`, settings.Rounds, MIN_ROUNDS, MAX_ROUNDS)
+	case settings.Capacity < MIN_CAPACITY || settings.Capacity > MAX_CAPACITY:
+		return fmt.Errorf(`invalid capacity: %v, must be between %v and %v`, settings.Capacity, MIN_CAPACITY, MAX_CAPACITY)
+	case !language.MatchString(settings.Language):
+		return fmt.Errorf(`invalid language: '%v', must be a 2 letter ISO 639-1 code`, settings.Language)
+	case len(settings.WordPacks) > MAX_WORD_PACKS:
+		return fmt.Errorf(`too many word packs: %v, the maximum is %v`, len(settings.WordPacks), MAX_WORD_PACKS)
+	case !permissions[settings.Drawing]:
+		return fmt.Errorf(`invalid drawing permission: '%v'`, settings.Drawing)
+	case !filter.Actions[settings.Filter]:
+		return fmt.Errorf(`invalid filter action: '%v'`, settings.Filter)
+	case len(settings.Terms) > MAX_FILTER_TERMS:
+		return fmt.Errorf(`too many filtered terms: %v, the maximum is %v`, len(settings.Terms), MAX_FILTER_TERMS)
+	}
+	for _, term := range settings.Terms {
+		if filter.Normalize(term) == `` || utf8.RuneCountInString(term) > filter.MAX_TERM_LENGTH {
+			return fmt.Errorf(`invalid filtered term: '%v', must contain a letter and be at most %v characters`, term, filter.MAX_TERM_LENGTH)
+		}
+	}
+	words := settings.words()
+	for _, pack := range settings.WordPacks {
+		if pack == `` {
+			return fmt.Errorf(`word pack names cannot be empty`)
+		}
+		if words.MatchesName(pack) { //as with usernames, words that merely contain a filtered word are allowed
+			return fmt.Errorf(`invalid word pack: '%v' contains a filtered word`, pack)
+		}
+	}
+	return nil
+}
+
+//words returns the filter made up of the built-in list of words and the lobby's own terms
+func (settings Settings) words() *filter.Filter { return filter.Default.With(settings.Terms...) }
+
+//diff returns the JSON values of the fields that differ between two settings, keyed by their JSON name
+func (settings Settings) diff(old Settings) map[string]json.RawMessage {
+	var before, after map[string]json.RawMessage
+	bin, _ := json.Marshal(old) //errors are ignored as `Settings` only contains JSON safe types
+	json.Unmarshal(bin, &before)
+	bin, _ = json.Marshal(settings)
+	json.Unmarshal(bin, &after)
+	changes := make(map[string]json.RawMessage)
+	for field, value := range after {
+		if !bytes.Equal(before[field], value) {
+			changes[field] = value
+		}
+	}
+	return changes
+}
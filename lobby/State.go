@@ -0,0 +1,88 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"context"
+	"fmt"
+)
+
+//State is a stage in the lifecycle of a lobby. A lobby only ever moves forward through the stages:
+//CREATED -> ACTIVE -> DRAINING -> CLOSED
+type State int
+
+const (
+	CREATED  State = iota //the lobby is usable but has not been added to a manager
+	ACTIVE                //the lobby has been added to a manager
+	DRAINING              //the lobby is empty or `Close()` was called, new users and messages are rejected
+	CLOSED                //the lobby's goroutine has exited and it has been removed from its manager
+)
+
+func (state State) String() string {
+	switch state {
+	case CREATED:
+		return `created`
+	case ACTIVE:
+		return `active`
+	case DRAINING:
+		return `draining`
+	case CLOSED:
+		return `closed`
+	}
+	return fmt.Sprintf(`State(%d)`, int(state))
+}
+
+//State is an accessor for the current stage in the lifecycle of a lobby
+func (lobby *Lobby) State() State {
+	lobby.RLock()
+	defer lobby.RUnlock()
+	return lobby.state
+}
+
+//Context is an accessor for a lobby's context. It is cancelled as soon as the lobby starts to shutdown
+//so that anything tied to the lobby can stop as well. It is immutable
+func (lobby *Lobby) Context() context.Context { return lobby.ctx }
+
+//Close starts the shutdown of a lobby without blocking. The lobby's `userManager()` goroutine will release
+//its users and signal its manager, if any, to delete it. Returns an error if the lobby is already shutting down
+func (lobby *Lobby) Close() error {
+	lobby.Lock()
+	defer lobby.Unlock()
+	return lobby.close()
+}
+
+//close is the mutex free version of Close(). Internal use only!
+func (lobby *Lobby) close() error {
+	if lobby.state >= DRAINING {
+		return fmt.Errorf(`lobby: '%v' is already %v`, lobby.name, lobby.state)
+	}
+	lobby.state = DRAINING
+	lobby.cancel()
+	return nil
+}
+
+//open returns an error if a lobby is shutting down and can no longer be used. Internal use only!
+func (lobby *Lobby) open() error {
+	if lobby.state >= DRAINING {
+		return fmt.Errorf(`lobby: '%v' is %v`, lobby.name, lobby.state)
+	}
+	return nil
+}
+
+//finish is the final step of the shutdown of a lobby, called by the `userManager()` goroutine as it exits.
+//Users no longer notify the lobby when they disconnect and the lobby's manager is signaled to delete it
+func (lobby *Lobby) finish() {
+	lobby.Lock()
+	lobby.state = CLOSED
+	for _, u := range lobby.users {
+		u.OnDisconnect(nil)
+	}
+	for _, u := range lobby.queue {
+		u.OnDisconnect(nil)
+	}
+	lobby.record(false, nil)
+	shutdown := lobby.shutdown
+	lobby.Unlock()
+	if shutdown != nil { //lobbies that were never added to a manager have nobody to signal
+		shutdown <- lobby.id
+	}
+}
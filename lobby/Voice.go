@@ -0,0 +1,78 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"Palette/lobby/user"
+	"fmt"
+)
+
+//VoiceState is the state of a user's microphone in the voice chat of a lobby
+type VoiceState struct {
+	Muted      bool `json:"muted"`      //muted by the user themselves
+	PushToTalk bool `json:"pushToTalk"` //whether the user is only heard while they hold their push-to-talk key
+	Talking    bool `json:"talking"`    //whether the push-to-talk key is held
+	HostMuted  bool `json:"hostMuted"`  //muted by the host, only the host can unmute them
+}
+
+//audible reports whether a user with this state can be heard
+func (state VoiceState) audible() bool {
+	return !state.Muted && !state.HostMuted && (!state.PushToTalk || state.Talking)
+}
+
+//Voice is an accessor for the voice state of a user in a lobby
+func (lobby *Lobby) Voice(usr *user.User) VoiceState {
+	lobby.RLock()
+	defer lobby.RUnlock()
+	return lobby.voice[usr]
+}
+
+//Audible reports whether the voice of a user should be forwarded to the other members of a lobby, that is whether
+//voice chat is enabled in the lobby's settings, the user has joined the lobby and they are not muted
+func (lobby *Lobby) Audible(usr *user.User) bool {
+	lobby.RLock()
+	defer lobby.RUnlock()
+	return lobby.settings.Voice && lobby.users[usr.Name()] == usr && lobby.voice[usr].audible()
+}
+
+//SetVoice is a mutator for the voice state of a user as reported by their client. Whether they were muted by the
+//host cannot be changed by the user. The new state is broadcasted to every member of the lobby.
+//Returns an error if the user has not joined the lobby
+func (lobby *Lobby) SetVoice(usr *user.User, state VoiceState) error {
+	lobby.Lock()
+	defer lobby.Unlock()
+	name := usr.Name()
+	if lobby.users[name] != usr {
+		return fmt.Errorf(`unable to change voice state in lobby: '%v': '%v' has not joined this lobby`, lobby.name, name)
+	}
+	state.HostMuted = lobby.voice[usr].HostMuted
+	lobby.setVoice(usr, state)
+	return nil
+}
+
+//HostMute mutes or unmutes the voice of a user on behalf of the user with the name `by`.
+//Returns an error if `by` is not the host or `name` has not joined the lobby
+func (lobby *Lobby) HostMute(by, name string, muted bool) error {
+	lobby.Lock()
+	defer lobby.Unlock()
+	if !lobby.authorized(by) {
+		return fmt.Errorf(`'%v' is not allowed to mute users in '%v'`, by, lobby.name)
+	}
+	usr := lobby.users[name]
+	if usr == nil {
+		return fmt.Errorf(`unable to mute '%v' in lobby: '%v': '%v' has not joined this lobby`, name, lobby.name, name)
+	}
+	state := lobby.voice[usr]
+	state.HostMuted = muted
+	lobby.setVoice(usr, state)
+	return nil
+}
+
+//setVoice replaces the voice state of a user and broadcasts it to every member of the lobby in the form of
+//`{"type": "voice", "data": {"user": "<name>", "state": VoiceState}}`. Internal use only!
+func (lobby *Lobby) setVoice(usr *user.User, state VoiceState) {
+	if lobby.voice[usr] == state {
+		return
+	}
+	lobby.voice[usr] = state
+	lobby.broadcast(Event{`voice`, map[string]interface{}{`user`: usr.Name(), `state`: state}})
+}
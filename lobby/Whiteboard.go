@@ -0,0 +1,135 @@
+// Palette © Albert Bregonia 2021
+package lobby
+
+import (
+	"Palette/lobby/user"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+//ARTIST is the attribute of the user that is currently drawing when the lobby's drawing permission is `artist`
+const ARTIST = `artist`
+
+//Stroke is a message of whiteboard data drawn by a user
+type Stroke struct {
+	Sender string
+	Time   time.Time //time the stroke was received by the lobby
+	Data   []byte
+}
+
+//MAX_WHITEBOARD_STROKES is the number of messages of whiteboard data a lobby keeps to redraw the whiteboard of users
+//that join or reconnect later. Once the whiteboard is full, the oldest strokes are dropped
+const MAX_WHITEBOARD_STROKES = 10000
+
+//Draw relays whiteboard data sent by a user over their `strokes` channel to every other user in the lobby.
+//Requests to replay the whiteboard in the form of `{"replay": {"speed": n}}` are handled by `Lobby.Replay()` instead,
+//they are allowed from users that cannot draw but count towards their command budget and are refused while they are
+//muted, unless the request stops a replay. Returns an error if the user has not joined the lobby, is not allowed to
+//draw by the lobby's settings or is over their drawing budget, see `Limits`
+func (lobby *Lobby) Draw(sender *user.User, data []byte) error {
+	name := sender.Name()
+	lobby.RLock()
+	member := lobby.users[name] == sender
+	allowed := lobby.canDraw(sender)
+	lobby.RUnlock()
+	request := struct { //whiteboard data that is not a stroke
+		Replay *struct {
+			Speed int `json:"speed"`
+		} `json:"replay"`
+	}{}
+	requested := json.Unmarshal(data, &request) == nil && request.Replay != nil
+	switch {
+	case !member:
+		return fmt.Errorf(`unable to draw in lobby: '%v': '%v' has not joined this lobby`, lobby.Name(), name)
+	case requested && request.Replay.Speed != 0 && lobby.muted(sender): //stopping a replay is always allowed
+		return fmt.Errorf(`unable to replay whiteboard: '%v' is muted for flooding`, name)
+	case requested && request.Replay.Speed != 0 && !lobby.Allow(sender, TRAFFIC_COMMANDS):
+		return fmt.Errorf(`unable to replay whiteboard: '%v' is requesting replays too quickly`, name)
+	case requested:
+		return lobby.Replay(sender, request.Replay.Speed)
+	case !allowed:
+		return fmt.Errorf(`unable to draw in lobby: '%v': '%v' is not allowed to draw`, lobby.Name(), name)
+	case !lobby.Allow(sender, TRAFFIC_DRAWING):
+		return fmt.Errorf(`unable to draw in lobby: '%v': '%v' is drawing too quickly`, lobby.Name(), name)
+	}
+	lobby.Lock()
+	defer lobby.Unlock()
+	if len(lobby.strokes) == MAX_WHITEBOARD_STROKES {
+		lobby.strokes = lobby.strokes[1:] //the strokes themselves are never modified as users may still be redrawing them
+	}
+	lobby.strokes = append(lobby.strokes, Stroke{name, time.Now(), append([]byte{}, data...)}) //the data may be reused by the transport
+	if lobby.recorder != nil {
+		lobby.recorder.Stroke(name, data)
+	}
+	for _, usr := range lobby.users {
+		if usr != sender {
+			usr.SendStroke(data) //users that are trying to reconnect are skipped
+		}
+	}
+	return nil
+}
+
+//SendWhiteboard redraws the whiteboard of a user by sending them every stroke of the lobby over their `strokes`
+//channel, ie. once they have joined or reconnected. Returns an error if the user is not connected
+func (lobby *Lobby) SendWhiteboard(usr *user.User) error {
+	lobby.RLock()
+	strokes := lobby.strokes
+	lobby.RUnlock()
+	for _, stroke := range strokes {
+		if e := usr.SendStroke(stroke.Data); e != nil {
+			return fmt.Errorf(`unable to send whiteboard: %v`, e)
+		}
+	}
+	return nil
+}
+
+//Presence relays presence data sent by a user over their `presence` channel, such as the position of their cursor,
+//to every other user in the lobby. Presence is never stored and is dropped for users that have fallen behind.
+//Returns an error if the user has not joined the lobby or is over their presence budget, see `Limits`
+func (lobby *Lobby) Presence(sender *user.User, data []byte) error {
+	name := sender.Name()
+	lobby.RLock()
+	member := lobby.users[name] == sender
+	lobby.RUnlock()
+	switch {
+	case !member:
+		return fmt.Errorf(`unable to share presence in lobby: '%v': '%v' has not joined this lobby`, lobby.Name(), name)
+	case !lobby.Allow(sender, TRAFFIC_PRESENCE):
+		return fmt.Errorf(`unable to share presence in lobby: '%v': '%v' is sending presence too quickly`, lobby.Name(), name)
+	}
+	lobby.RLock()
+	defer lobby.RUnlock()
+	for _, usr := range lobby.users {
+		if usr != sender {
+			usr.SendPresence(data)
+		}
+	}
+	return nil
+}
+
+//Strokes returns every stroke of a lobby's whiteboard in the order they were drawn. The strokes must not be modified
+func (lobby *Lobby) Strokes() []Stroke {
+	lobby.RLock()
+	defer lobby.RUnlock()
+	return lobby.strokes
+}
+
+//ClearWhiteboard removes every stroke of a lobby's whiteboard, ie. at the start of a round
+func (lobby *Lobby) ClearWhiteboard() {
+	lobby.Lock()
+	defer lobby.Unlock()
+	lobby.strokes = nil
+}
+
+//canDraw reports whether the lobby's drawing permission allows a user to draw. Internal use only!
+func (lobby *Lobby) canDraw(usr *user.User) bool {
+	switch lobby.settings.Drawing {
+	case `everyone`:
+		return true
+	case `artist`:
+		artist, _ := usr.Attribute(ARTIST).(bool)
+		return artist || usr == lobby.host
+	}
+	return usr == lobby.host
+}
@@ -0,0 +1,211 @@
+// Palette © Albert Bregonia 2021
+package filter
+
+import (
+	"strings"
+	"unicode"
+)
+
+// The filter package finds unwanted words in chat messages, usernames and word packs
+
+//Actions a lobby can take when a chat message contains a filtered word
+const (
+	MASK  = `mask`  //the filtered words are replaced by `*` before the message is delivered
+	BLOCK = `block` //the message is not delivered and its sender is told why
+	FLAG  = `flag`  //the message is delivered as-is and the moderators of the lobby are notified
+	OFF   = `off`   //the message is not filtered
+)
+
+//Actions is the set of valid actions of a filter
+var Actions = map[string]bool{MASK: true, BLOCK: true, FLAG: true, OFF: true}
+
+//MAX_TERM_LENGTH is the maximum number of characters in a custom term
+const MAX_TERM_LENGTH = 32
+
+//builtin is the list of words that every filter starts with
+var builtin = []string{
+	`anal`, `anus`, `arse`, `arsehole`, `ass`, `asshole`, `bastard`, `bitch`, `bollocks`, `boner`, `bullshit`,
+	`clit`, `cock`, `cocksucker`, `crap`, `cum`, `cunt`, `dick`, `dickhead`, `dildo`, `dyke`, `fag`, `faggot`,
+	`fuck`, `fucked`, `fucker`, `fucking`, `jizz`, `motherfucker`, `nigga`, `nigger`, `penis`, `piss`, `porn`,
+	`pussy`, `retard`, `shit`, `shitty`, `slut`, `tits`, `twat`, `vagina`, `wank`, `wanker`, `whore`,
+}
+
+//Default is the filter made up of the built-in list of words
+var Default = New(builtin...)
+
+/*
+	Filter is an immutable set of words to be filtered.
+
+	Text is normalized before it is compared with the words of a filter so that common ways of getting around a filter
+	are caught: letters are lowercased, diacritics are removed (`fück` is `fuck`), leetspeak is read as letters
+	(`sh1t` is `shit`), symbols inside a word are ignored (`f.u.c.k` is `fuck`) and repeated letters match a single
+	letter (`fuuuck` is `fuck`). Use `With()` to extend a filter, ie. with the custom terms of a lobby.
+*/
+type Filter struct {
+	terms map[string][][]int //run lengths of the letters of every normalized word keyed by its letters without repeats
+}
+
+//Constructor for a filter of the given words. Words that are empty after normalization are ignored
+func New(terms ...string) *Filter {
+	filter := &Filter{make(map[string][][]int)}
+	for _, term := range terms {
+		if letters, counts := runs(Normalize(term)); letters != `` {
+			filter.terms[letters] = append(filter.terms[letters], counts)
+		}
+	}
+	return filter
+}
+
+//With returns a new filter made up of the words of a filter and the given words
+func (filter *Filter) With(terms ...string) *Filter {
+	extended := New(terms...)
+	for letters, counts := range filter.terms {
+		extended.terms[letters] = append(extended.terms[letters], counts...)
+	}
+	return extended
+}
+
+//Match is a filtered word found in a text, `Start` and `End` are the indices of its first and last rune + 1
+type Match struct {
+	Word       string
+	Start, End int
+}
+
+//Find returns every filtered word of a text. A word is a run of characters between whitespace
+func (filter *Filter) Find(text string) []Match {
+	matches := make([]Match, 0)
+	runes := []rune(text)
+	for start := 0; start < len(runes); {
+		if unicode.IsSpace(runes[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(runes) && !unicode.IsSpace(runes[end]) {
+			end++
+		}
+		word := string(runes[start:end])
+		if filter.matches(Normalize(word)) || filter.matches(Normalize(strings.TrimRight(word, `.,!?;:'"`))) {
+			matches = append(matches, Match{word, start, end})
+		}
+		start = end
+	}
+	return matches
+}
+
+//matches reports whether a normalized word is one of the words of a filter, allowing any letter to be repeated
+func (filter *Filter) matches(word string) bool {
+	letters, counts := runs(word)
+next:
+	for _, term := range filter.terms[letters] {
+		for i := range term {
+			if counts[i] < term[i] {
+				continue next //`as` must not match `ass`
+			}
+		}
+		return true
+	}
+	return false
+}
+
+//Mask returns a text with every rune of every filtered word replaced by `*` and whether anything was masked
+func (filter *Filter) Mask(text string) (string, bool) {
+	matches := filter.Find(text)
+	if len(matches) == 0 {
+		return text, false
+	}
+	runes := []rune(text)
+	for _, match := range matches {
+		for i := match.Start; i < match.End; i++ {
+			runes[i] = '*'
+		}
+	}
+	return string(runes), true
+}
+
+//Contains reports whether a filtered word appears anywhere in a text, even as part of another word. This is stricter
+//than `Find()` and is meant for short texts without spaces such as usernames. Words shorter than 4 letters are too
+//common inside other words, ie. `ass` in `Cassandra`, and only match the whole text
+func (filter *Filter) Contains(text string) bool {
+	normalized := Normalize(text)
+	if filter.matches(normalized) {
+		return true
+	}
+	letters, _ := runs(normalized)
+	for term := range filter.terms {
+		if len(term) >= 4 && strings.Contains(letters, term) {
+			return true
+		}
+	}
+	return false
+}
+
+//MatchesName reports whether a name, such as a username, is a filtered word or contains one as a whole word. Words
+//of a name are separated by whitespace, `_` or `-`. Unlike `Contains()`, filtered words inside other words are not
+//matched, so that real names such as `Dickson` or `Scunthorpe` are allowed
+func (filter *Filter) MatchesName(name string) bool {
+	if filter.matches(Normalize(name)) {
+		return true
+	}
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool { return unicode.IsSpace(r) || r == '_' || r == '-' }) {
+		if filter.matches(Normalize(word)) {
+			return true
+		}
+	}
+	return false
+}
+
+// === Normalization === //
+
+//leet maps characters commonly used in place of letters to those letters
+var leet = map[rune]rune{
+	'0': 'o', '1': 'i', '2': 'z', '3': 'e', '4': 'a', '5': 's', '6': 'g', '7': 't', '8': 'b', '9': 'g',
+	'@': 'a', '$': 's', '!': 'i', '|': 'l', '+': 't', '€': 'e', '£': 'l', '¥': 'y',
+}
+
+//diacritics maps letters with diacritics to their base letter
+var diacritics = map[rune]rune{}
+
+func init() {
+	for base, letters := range map[rune]string{
+		'a': `àáâãäåāăąǎ`, 'c': `çćĉċč`, 'd': `ďđ`, 'e': `èéêëēĕėęě`, 'g': `ĝğġģ`, 'h': `ĥħ`, 'i': `ìíîïĩīĭįı`,
+		'j': `ĵ`, 'k': `ķ`, 'l': `ĺļľŀł`, 'n': `ñńņňŉ`, 'o': `òóôõöøōŏőǒ`, 'r': `ŕŗř`, 's': `śŝşšß`, 't': `ţťŧ`,
+		'u': `ùúûüũūŭůűųǔ`, 'w': `ŵ`, 'y': `ýÿŷ`, 'z': `źżž`,
+	} {
+		for _, letter := range letters {
+			diacritics[letter] = base
+		}
+	}
+}
+
+//Normalize returns the form of a word that is compared with the words of a filter, see `Filter`
+func Normalize(word string) string {
+	normalized := make([]rune, 0, len(word))
+	for _, r := range strings.ToLower(word) {
+		if base, ok := diacritics[r]; ok {
+			r = base
+		} else if letter, ok := leet[r]; ok {
+			r = letter
+		}
+		if !unicode.IsLetter(r) {
+			continue //symbols are ignored
+		}
+		normalized = append(normalized, r)
+	}
+	return string(normalized)
+}
+
+//runs splits a normalized word into its letters without repeats and the number of times each letter is repeated
+func runs(word string) (string, []int) {
+	letters := make([]rune, 0, len(word))
+	counts := make([]int, 0, len(word))
+	for _, r := range word {
+		if len(letters) > 0 && letters[len(letters)-1] == r {
+			counts[len(counts)-1]++
+			continue
+		}
+		letters = append(letters, r)
+		counts = append(counts, 1)
+	}
+	return string(letters), counts
+}
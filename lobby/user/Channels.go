@@ -0,0 +1,69 @@
+// Palette © Albert Bregonia 2021
+package user
+
+import (
+	"fmt"
+)
+
+//Labels of the channels of every user, see `CHANNELS`
+const (
+	EVENTS   = `events`   //lobby events such as queue positions and kicks, and control messages from the client
+	CHAT     = `chat`     //chat messages, reactions, deletions and chat history
+	STROKES  = `strokes`  //whiteboard data
+	PRESENCE = `presence` //short-lived state of other users, such as the position of their cursor
+)
+
+//Spec declares a channel that the server opens to every user along with its delivery guarantees
+type Spec struct {
+	Label          string
+	Ordered        bool //whether messages are delivered in the order they were sent
+	MaxRetransmits int  //number of times a lost message is sent again before it is given up on, -1 for reliable delivery
+	Essential      bool //whether messages are kept rather than dropped while the user is behind, see `Queue`
+}
+
+//Reliable reports whether every message of the channel is delivered
+func (spec Spec) Reliable() bool { return spec.MaxRetransmits < 0 }
+
+/*
+	CHANNELS is the catalogue of channels the server creates for every user during signaling.
+
+	Strokes are only sent again a few times as a stroke that arrives late is already outdated, but they are still
+	essential as every stroke is part of the drawing. Presence is neither ordered nor reliable: a lost cursor position is
+	soon replaced by a newer one, which is also why it is the first traffic to be dropped when a user falls behind.
+*/
+var CHANNELS = []Spec{
+	{Label: EVENTS, Ordered: true, MaxRetransmits: -1, Essential: true},
+	{Label: CHAT, Ordered: true, MaxRetransmits: -1, Essential: true},
+	{Label: STROKES, Ordered: true, MaxRetransmits: 3, Essential: true},
+	{Label: PRESENCE, Ordered: false, MaxRetransmits: 0, Essential: false},
+}
+
+//SendEvent sends the JSON of an event to a user over their `events` channel
+func (user *User) SendEvent(bin []byte) error { return user.sendText(EVENTS, bin) }
+
+//SendChat sends the JSON of a chat message or update to a user over their `chat` channel
+func (user *User) SendChat(bin []byte) error { return user.sendText(CHAT, bin) }
+
+//SendStroke sends whiteboard data to a user over their `strokes` channel
+func (user *User) SendStroke(data []byte) error { return user.send(STROKES, data) }
+
+//SendPresence sends presence data to a user over their `presence` channel
+func (user *User) SendPresence(data []byte) error { return user.send(PRESENCE, data) }
+
+//send sends binary data to a user over a channel. Returns an error if the user is not connected. Internal use only!
+func (user *User) send(label string, data []byte) error {
+	channel := user.Channel(label)
+	if channel == nil { //the user is trying to reconnect
+		return fmt.Errorf(`unable to send to '%v' over channel '%v': not connected`, user.Name(), label)
+	}
+	return channel.Send(data)
+}
+
+//sendText sends text to a user over a channel. Returns an error if the user is not connected. Internal use only!
+func (user *User) sendText(label string, text []byte) error {
+	channel := user.Channel(label)
+	if channel == nil { //the user is trying to reconnect
+		return fmt.Errorf(`unable to send to '%v' over channel '%v': not connected`, user.Name(), label)
+	}
+	return channel.SendText(string(text))
+}
@@ -0,0 +1,276 @@
+// Palette © Albert Bregonia 2021
+package user
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Watermarks are the backpressure settings of the outbound queue of a channel, see `Queue`.
+
+	A peer has fallen behind once more than `High` bytes are waiting to be sent to it and has caught up once less than
+	`Low` bytes are waiting. Peers that stay behind for longer than `Stall` or have more than `Max` bytes waiting are
+	considered stuck and disconnected.
+*/
+type Watermarks struct {
+	Low, High, Max uint64
+	Stall          time.Duration
+}
+
+//DefaultWatermarks returns the backpressure settings used by every channel unless the server chooses otherwise
+func DefaultWatermarks() Watermarks {
+	return Watermarks{
+		Low:   64 << 10,
+		High:  1 << 20,
+		Max:   16 << 20,
+		Stall: 10 * time.Second,
+	}
+}
+
+//QueueMetrics are the counters of every outbound queue of the server, see `Metrics()`
+type QueueMetrics struct {
+	Sent         uint64 `json:"sent"`         //messages sent to peers
+	Dropped      uint64 `json:"dropped"`      //non-essential messages dropped as their peer had fallen behind
+	Behind       int64  `json:"behind"`       //channels whose peer is currently behind
+	Disconnected uint64 `json:"disconnected"` //peers disconnected for being stuck
+}
+
+//metrics are the counters of every queue, only ever accessed atomically
+var metrics QueueMetrics
+
+//Metrics returns a snapshot of the counters of every outbound queue of the server
+func Metrics() QueueMetrics {
+	return QueueMetrics{
+		Sent:         atomic.LoadUint64(&metrics.Sent),
+		Dropped:      atomic.LoadUint64(&metrics.Dropped),
+		Behind:       atomic.LoadInt64(&metrics.Behind),
+		Disconnected: atomic.LoadUint64(&metrics.Disconnected),
+	}
+}
+
+//bufferedChannel is a channel that reports the amount of data it has yet to send, such as a WebRTC DataChannel
+type bufferedChannel interface {
+	BufferedAmount() uint64
+	SetBufferedAmountLowThreshold(threshold uint64)
+	OnBufferedAmountLow(handler func())
+}
+
+//outbound is a message waiting in a queue
+type outbound struct {
+	data []byte
+	text string
+	size uint64
+}
+
+/*
+	Queue is the outbound queue of a channel to a single peer, which is a `Channel` itself.
+
+	Sending over a queue never blocks: messages are sent by a goroutine of the queue in order, so a slow peer never stalls
+	a lobby that is sending to every user. If the channel reports how much data it has buffered, such as a WebRTC
+	DataChannel, the queue waits for the buffer to drain below the `Low` watermark whenever it goes over the `High`
+	watermark. Messages of non-essential channels, such as cursor updates that are soon replaced by newer ones, are
+	dropped while the peer is behind. Once a peer is stuck, the queue is closed and `onStuck` is called to disconnect it.
+*/
+type Queue struct {
+	channel   Channel
+	buffered  bufferedChannel //`nil` if the channel does not report the amount of data it has buffered
+	essential bool
+	limits    Watermarks
+	onStuck   func()
+	messages  []outbound
+	queued    uint64    //bytes waiting in `messages`
+	behind    time.Time //time the peer fell behind, `NIL_TIME` if it has not
+	closed    bool
+	wake, low chan struct{}
+	sync.Mutex
+}
+
+//NewQueue is the constructor for the outbound queue of a channel. `onStuck` is called once if the peer becomes stuck
+func NewQueue(channel Channel, essential bool, limits Watermarks, onStuck func()) *Queue {
+	queue := &Queue{
+		channel:   channel,
+		essential: essential,
+		limits:    limits,
+		onStuck:   onStuck,
+		behind:    NIL_TIME,
+		wake:      make(chan struct{}, 1),
+		low:       make(chan struct{}, 1),
+	}
+	if buffered, ok := channel.(bufferedChannel); ok {
+		queue.buffered = buffered
+		buffered.SetBufferedAmountLowThreshold(limits.Low)
+		buffered.OnBufferedAmountLow(func() { signal(queue.low) })
+	}
+	go queue.run()
+	return queue
+}
+
+//Label is an accessor for the label of the queue's channel
+func (queue *Queue) Label() string { return queue.channel.Label() }
+
+//Send queues binary data to be sent over the channel
+func (queue *Queue) Send(data []byte) error {
+	return queue.enqueue(outbound{data: append([]byte{}, data...), size: uint64(len(data))}) //the data may be reused by the caller
+}
+
+//SendText queues text to be sent over the channel
+func (queue *Queue) SendText(text string) error {
+	return queue.enqueue(outbound{text: text, size: uint64(len(text))})
+}
+
+//Close stops a queue, messages that have not been sent yet are dropped
+func (queue *Queue) Close() {
+	queue.Lock()
+	defer queue.Unlock()
+	queue.close()
+}
+
+//enqueue adds a message to a queue, drops it if the peer is behind and the channel is not essential
+//or disconnects the peer if it is stuck. Internal use only!
+func (queue *Queue) enqueue(msg outbound) error {
+	queue.Lock()
+	defer queue.Unlock()
+	if queue.closed {
+		return fmt.Errorf(`unable to send over channel '%v': closed`, queue.channel.Label())
+	}
+	pending := queue.pending()
+	queue.track(pending)
+	switch {
+	case pending+msg.size > queue.limits.Max || (queue.behind != NIL_TIME && time.Since(queue.behind) > queue.limits.Stall):
+		queue.stuck()
+		return fmt.Errorf(`unable to send over channel '%v': peer is stuck`, queue.channel.Label())
+	case queue.behind != NIL_TIME && !queue.essential:
+		atomic.AddUint64(&metrics.Dropped, 1)
+		return nil
+	}
+	queue.messages = append(queue.messages, msg)
+	queue.queued += msg.size
+	signal(queue.wake)
+	return nil
+}
+
+//run sends the messages of a queue in order until it is closed. Internal use only!
+func (queue *Queue) run() {
+	for {
+		queue.Lock()
+		for len(queue.messages) == 0 && !queue.closed {
+			queue.Unlock()
+			<-queue.wake
+			queue.Lock()
+		}
+		if queue.closed {
+			queue.Unlock()
+			return
+		}
+		msg := queue.messages[0]
+		queue.messages[0] = outbound{} //release the data of the message
+		queue.messages = queue.messages[1:]
+		queue.Unlock()
+		if !queue.drain() {
+			return
+		}
+		var e error
+		if msg.data != nil {
+			e = queue.channel.Send(msg.data)
+		} else {
+			e = queue.channel.SendText(msg.text)
+		}
+		if e == nil {
+			atomic.AddUint64(&metrics.Sent, 1)
+		}
+		queue.Lock()
+		if queue.closed { //closed while sending, `close()` has already emptied the queue and stopped tracking it
+			queue.Unlock()
+			return
+		}
+		queue.queued -= msg.size
+		queue.track(queue.pending())
+		queue.Unlock()
+	}
+}
+
+//drain waits for the buffer of the channel to go under the `Low` watermark if it is over the `High` watermark.
+//Returns false if the queue was closed or the peer is stuck in the meantime. Internal use only!
+func (queue *Queue) drain() bool {
+	if queue.buffered == nil || queue.buffered.BufferedAmount() <= queue.limits.High {
+		return true
+	}
+	timeout := time.NewTimer(queue.limits.Stall)
+	defer timeout.Stop()
+	for queue.buffered.BufferedAmount() > queue.limits.Low {
+		select {
+		case <-queue.low:
+		case <-queue.wake: //woken up by a new message or by `Close()`
+			queue.Lock()
+			closed := queue.closed
+			queue.Unlock()
+			if closed {
+				return false
+			}
+		case <-timeout.C:
+			queue.Lock()
+			queue.stuck()
+			queue.Unlock()
+			return false
+		}
+	}
+	return true
+}
+
+//pending returns the number of bytes waiting to be sent to the peer. The queue must be locked. Internal use only!
+func (queue *Queue) pending() uint64 {
+	if queue.buffered == nil {
+		return queue.queued
+	}
+	return queue.queued + queue.buffered.BufferedAmount()
+}
+
+//track marks the peer as behind or caught up given the number of bytes waiting to be sent to it.
+//The queue must be locked. Internal use only!
+func (queue *Queue) track(pending uint64) {
+	switch {
+	case queue.behind == NIL_TIME && pending > queue.limits.High:
+		queue.behind = time.Now()
+		atomic.AddInt64(&metrics.Behind, 1)
+	case queue.behind != NIL_TIME && pending < queue.limits.Low:
+		queue.behind = NIL_TIME
+		atomic.AddInt64(&metrics.Behind, -1)
+	}
+}
+
+//stuck closes a queue and disconnects its peer. The queue must be locked. Internal use only!
+func (queue *Queue) stuck() {
+	if queue.closed {
+		return
+	}
+	queue.close()
+	atomic.AddUint64(&metrics.Disconnected, 1)
+	if queue.onStuck != nil {
+		go queue.onStuck() //the caller may be holding the lock of a lobby
+	}
+}
+
+//close marks a queue as closed and wakes up its goroutine. The queue must be locked. Internal use only!
+func (queue *Queue) close() {
+	if queue.closed {
+		return
+	}
+	queue.closed = true
+	queue.messages, queue.queued = nil, 0
+	if queue.behind != NIL_TIME {
+		queue.behind = NIL_TIME
+		atomic.AddInt64(&metrics.Behind, -1)
+	}
+	signal(queue.wake)
+}
+
+//signal wakes up a goroutine waiting on a channel without blocking if it has already been woken up
+func signal(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
@@ -5,23 +5,38 @@ import (
 	"fmt"
 	"sync"
 	"time"
-
-	"github.com/pion/webrtc/v3"
 )
 
 //Unix epoch to be used as a `nil` value for time
 var NIL_TIME time.Time = time.Unix(0, 0)
 
+//SERVER_NAME is the name reserved for messages sent by the server, no user can have this name
+const SERVER_NAME = `Palette`
+
+/*
+	Channel is a labeled, message based stream from the server to a user.
+
+	A channel is usually a WebRTC DataChannel, which satisfies this interface as-is. Users that cannot establish a WebRTC
+	connection are served the same channels over their signaling WebSocket instead, so a lobby never has to know which
+	transport a user has.
+*/
+type Channel interface {
+	Label() string
+	Send(data []byte) error
+	SendText(text string) error
+}
+
 /*
 	Manages a single user's data and connection to the server.
 
-	As a user is required to have a single WebSocket connection for WebRTC signaling and multiple WebRTC DataChannels in order
+	As a user is required to have a single WebSocket connection for WebRTC signaling and multiple channels in order
 	to interact with the users in a lobby, a `User` is a named representation of those connections.
 */
 type User struct {
 	name       string
 	disconnect time.Time
-	channels   map[string]*webrtc.DataChannel //map of WebRTC data channels based on their label
+	onChange   func(*User)        //handler for changes to the time of disconnect
+	channels   map[string]Channel //map of channels based on their label
 	attributes map[string]interface{}
 	sync.RWMutex
 }
@@ -33,7 +48,7 @@ func New(name string) *User {
 	return &User{
 		name:       name,
 		disconnect: NIL_TIME,
-		channels:   make(map[string]*webrtc.DataChannel),
+		channels:   make(map[string]Channel),
 		attributes: make(map[string]interface{}),
 		RWMutex:    sync.RWMutex{},
 	}
@@ -55,36 +70,84 @@ func (user *User) TimeDisconnect() time.Time {
 	return user.disconnect
 }
 
-//Channel is an accessor for a channel in a user's map of WebRTC data channels given a label
-func (user *User) Channel(label string) *webrtc.DataChannel {
+//Channel is an accessor for a channel in a user's map of channels given a label
+func (user *User) Channel(label string) Channel {
 	user.RLock()
 	defer user.RUnlock()
 	return user.channels[label]
 }
 
+//Attribute is an accessor for an attribute of a user given its key, such as the role groups they are part of.
+//Returns `nil` if the attribute is not set
+func (user *User) Attribute(key string) interface{} {
+	user.RLock()
+	defer user.RUnlock()
+	return user.attributes[key]
+}
+
 // Mutators
 
 //SetName is a mutator for a user's name value
 func (user *User) SetName(name string) error {
 	user.Lock()
 	defer user.Unlock()
-	if len(name) == 0 || name == `Palette` {
-		return fmt.Errorf(`invalid name, username length must be > 0 and cannot be 'Palette'`)
+	if len(name) == 0 || name == SERVER_NAME {
+		return fmt.Errorf(`invalid name, username length must be > 0 and cannot be '%v'`, SERVER_NAME)
 	}
 	user.name = name
 	return nil
 }
 
-//SetTimeDisconnect is a mutator for a user's time of disconnect
+//SetTimeDisconnect is a mutator for a user's time of disconnect.
+//The handler set by `OnDisconnect()` is called after the time has been changed
 func (user *User) SetTimeDisconnect(time time.Time) {
 	user.Lock()
-	defer user.Unlock()
 	user.disconnect = time
+	handler := user.onChange
+	user.Unlock()
+	if handler != nil {
+		handler(user)
+	}
+}
+
+//OnDisconnect sets the handler that is called whenever a user's time of disconnect changes, `nil` removes the handler
+func (user *User) OnDisconnect(handler func(*User)) {
+	user.Lock()
+	defer user.Unlock()
+	user.onChange = handler
 }
 
-//SetChannel is a mutator for a channel in a user's map of WebRTC data channels given a label and channel pointer
-func (user *User) SetChannel(label string, channel *webrtc.DataChannel) {
+//SetChannel is a mutator for a channel in a user's map of channels given a label, `nil` removes the channel
+func (user *User) SetChannel(label string, channel Channel) {
 	user.Lock()
 	defer user.Unlock()
+	if channel == nil {
+		delete(user.channels, label)
+		return
+	}
 	user.channels[label] = channel
 }
+
+//SwapChannels replaces every channel of a user at once, so that the lobby never sees a mix of old and new
+//channels, ie. when a user reconnects with a new WebRTC connection. Returns the channels that were replaced
+func (user *User) SwapChannels(channels map[string]Channel) map[string]Channel {
+	user.Lock()
+	defer user.Unlock()
+	previous := user.channels
+	user.channels = make(map[string]Channel, len(channels))
+	for label, channel := range channels {
+		user.channels[label] = channel
+	}
+	return previous
+}
+
+//SetAttribute is a mutator for an attribute of a user given its key, `nil` removes the attribute
+func (user *User) SetAttribute(key string, value interface{}) {
+	user.Lock()
+	defer user.Unlock()
+	if value == nil {
+		delete(user.attributes, key)
+		return
+	}
+	user.attributes[key] = value
+}
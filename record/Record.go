@@ -0,0 +1,254 @@
+// Palette © Albert Bregonia 2021
+package record
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// The record package writes recordings of lobbies to disk, one directory per recording
+
+//Files of every recording
+const (
+	EVENT_LOG    = `events.jsonl` //one `Event` per line
+	VOICE_FORMAT = `voice-%d.ogg` //voice of a single track, numbered in the order the tracks started
+)
+
+/*
+	Config is the configuration of the recordings of the server.
+
+	Every recording is written to its own directory within `Directory`. Once a recording is started or stopped,
+	recordings older than `MaxAge` are deleted in the background, followed by the oldest recordings until there are at
+	most `MaxRecordings` that take up at most `MaxBytes` in total. Recordings in progress are never deleted. A limit of
+	0 disables it.
+*/
+type Config struct {
+	Directory     string
+	MaxAge        time.Duration
+	MaxRecordings int
+	MaxBytes      int64
+}
+
+/*
+	Event is a line of the event log of a recording.
+
+	`Time` is the number of milliseconds since the recording started, which is also the start of every voice file, so
+	that the log can be replayed in sync with the voice. The kinds of events are:
+
+		{"type": "stroke", "user": "<name>", "data": "<base64 whiteboard data>"}
+		{"type": "chat", "data": <JSON sent over the chat channel of every user>}
+		{"type": "voice", "user": "<name>", "data": "voice-<n>.ogg"} once the voice of a track is first heard
+
+	Strokes that were already on the whiteboard when the recording started are written first.
+*/
+type Event struct {
+	Time int64       `json:"time"`
+	Type string      `json:"type"`
+	User string      `json:"user,omitempty"`
+	Data interface{} `json:"data"`
+}
+
+//active are the directories of the recordings in progress, which are never deleted
+var active = struct {
+	directories map[string]bool
+	sync.Mutex
+}{directories: make(map[string]bool)}
+
+//pruning is held by `Prune()` so that only one of the goroutines started by recordings deletes at a time
+var pruning sync.Mutex
+
+//Recording is a recording in progress
+type Recording struct {
+	config    Config
+	directory string
+	start     time.Time
+	log       *os.File
+	encoder   *json.Encoder
+	voices    map[uint32]*oggwriter.OggWriter //voice files by the SSRC of their track
+	closed    bool
+	sync.Mutex
+}
+
+//Start starts a recording in a new directory named after the current time and `name`, ie. the ID of a lobby, followed
+//by a number if another recording of the same name was started within the same second.
+//Returns an error if the directory or event log cannot be created
+func Start(config Config, name string) (*Recording, error) {
+	start := time.Now()
+	if e := os.MkdirAll(config.Directory, 0750); e != nil {
+		return nil, fmt.Errorf(`unable to start recording: %v`, e)
+	}
+	base := filepath.Join(config.Directory, fmt.Sprintf(`%v-%v`, start.UTC().Format(`20060102-150405`), name))
+	directory := base
+	active.Lock() //the directory is in progress before `Prune()` can see it
+	e := os.Mkdir(directory, 0750)
+	for n := 2; errors.Is(e, fs.ErrExist); n++ {
+		directory = fmt.Sprintf(`%v-%v`, base, n)
+		e = os.Mkdir(directory, 0750)
+	}
+	if e == nil {
+		active.directories[directory] = true
+	}
+	active.Unlock()
+	if e != nil {
+		return nil, fmt.Errorf(`unable to start recording: %v`, e)
+	}
+	log, e := os.OpenFile(filepath.Join(directory, EVENT_LOG), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if e != nil {
+		active.Lock()
+		delete(active.directories, directory)
+		active.Unlock()
+		return nil, fmt.Errorf(`unable to start recording: %v`, e)
+	}
+	go Prune(config) //recordings are started by lobbies that are locked, which must not wait for the disk
+	return &Recording{
+		config:    config,
+		directory: directory,
+		start:     start,
+		log:       log,
+		encoder:   json.NewEncoder(log),
+		voices:    make(map[uint32]*oggwriter.OggWriter),
+	}, nil
+}
+
+//Directory is an accessor for the directory of a recording
+func (recording *Recording) Directory() string { return recording.directory }
+
+//Stroke writes whiteboard data drawn by a user to the event log of a recording
+func (recording *Recording) Stroke(name string, data []byte) {
+	recording.Lock()
+	defer recording.Unlock()
+	recording.write(Event{Type: `stroke`, User: name, Data: data})
+}
+
+//Chat writes the JSON of a chat message or update sent to every user to the event log of a recording
+func (recording *Recording) Chat(update []byte) {
+	recording.Lock()
+	defer recording.Unlock()
+	recording.write(Event{Type: `chat`, Data: json.RawMessage(update)})
+}
+
+//Voice writes an Opus packet of a user's voice to the voice file of its track, which is created on the first packet
+func (recording *Recording) Voice(name string, packet *rtp.Packet) {
+	recording.Lock()
+	defer recording.Unlock()
+	if recording.closed {
+		return
+	}
+	voice := recording.voices[packet.SSRC]
+	if voice == nil {
+		file := fmt.Sprintf(VOICE_FORMAT, len(recording.voices)+1)
+		var e error
+		if voice, e = oggwriter.New(filepath.Join(recording.directory, file), 48000, 2); e != nil {
+			return
+		}
+		recording.voices[packet.SSRC] = voice
+		recording.write(Event{Type: `voice`, User: name, Data: file})
+	}
+	voice.WriteRTP(packet)
+}
+
+//Close stops a recording and closes its files, then deletes the recordings that are over the retention limits in the background
+func (recording *Recording) Close() error {
+	recording.Lock()
+	if recording.closed {
+		recording.Unlock()
+		return nil
+	}
+	recording.closed = true
+	for _, voice := range recording.voices {
+		voice.Close()
+	}
+	e := recording.log.Close()
+	recording.Unlock()
+	active.Lock()
+	delete(active.directories, recording.directory)
+	active.Unlock()
+	go Prune(recording.config)
+	if e != nil {
+		return fmt.Errorf(`unable to stop recording: %v`, e)
+	}
+	return nil
+}
+
+//write writes an event to the event log of a recording. The recording must be locked. Internal use only!
+func (recording *Recording) write(event Event) {
+	if recording.closed {
+		return
+	}
+	event.Time = time.Since(recording.start).Milliseconds()
+	recording.encoder.Encode(event) //a recording that cannot be written to is incomplete, the lobby goes on regardless
+}
+
+//Prune deletes the recordings that are over the retention limits of a configuration, oldest first.
+//Returns an error if the recordings cannot be listed
+func Prune(config Config) error {
+	pruning.Lock()
+	defer pruning.Unlock()
+	entries, e := os.ReadDir(config.Directory)
+	if e != nil {
+		return fmt.Errorf(`unable to prune recordings: %v`, e)
+	}
+	type recording struct {
+		directory string
+		modified  time.Time
+		size      int64
+	}
+	recordings := make([]recording, 0, len(entries))
+	for _, entry := range entries {
+		directory := filepath.Join(config.Directory, entry.Name())
+		if !entry.IsDir() || inProgress(directory) {
+			continue
+		}
+		info, e := entry.Info()
+		if e != nil {
+			continue
+		}
+		r := recording{directory: directory, modified: info.ModTime()}
+		filepath.WalkDir(directory, func(path string, file fs.DirEntry, e error) error {
+			if e == nil && !file.IsDir() {
+				if info, e := file.Info(); e == nil {
+					r.size += info.Size()
+				}
+			}
+			return nil
+		})
+		recordings = append(recordings, r)
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].modified.Before(recordings[j].modified) })
+	var total int64
+	for _, r := range recordings {
+		total += r.size
+	}
+	for i, r := range recordings {
+		remaining := len(recordings) - i
+		switch {
+		case config.MaxAge > 0 && time.Since(r.modified) > config.MaxAge:
+		case config.MaxRecordings > 0 && remaining > config.MaxRecordings:
+		case config.MaxBytes > 0 && total > config.MaxBytes:
+		default:
+			return nil //every remaining recording is newer
+		}
+		if e := os.RemoveAll(r.directory); e == nil {
+			total -= r.size
+		}
+	}
+	return nil
+}
+
+//inProgress reports whether a directory is the directory of a recording in progress. Directories are only in
+//progress from the moment they are created, so one that was not cannot be afterwards. Internal use only!
+func inProgress(directory string) bool {
+	active.Lock()
+	defer active.Unlock()
+	return active.directories[directory]
+}
@@ -0,0 +1,197 @@
+// Palette © Albert Bregonia 2021
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// The relay package runs the optional built-in TURN/STUN server for users behind restrictive networks
+
+//DEFAULT_CREDENTIAL_TTL is how long the credentials of a session are valid unless configured otherwise
+const DEFAULT_CREDENTIAL_TTL = 10 * time.Minute
+
+//ALLOCATION_IDLE is how long the server remembers a client that was allowed in without hearing from it again. TURN
+//clients refresh their allocation at least every 10 minutes, see `Server.authenticate()`
+const ALLOCATION_IDLE = 15 * time.Minute
+
+//MAX_CLIENTS is how many clients the server remembers at most, see `Server.authenticate()`
+const MAX_CLIENTS = 10000
+
+//Config is the configuration of the built-in TURN/STUN server
+type Config struct {
+	PublicIP         string        //IP address that users reach the server at, it is announced in the ICE servers of every session
+	Address          string        //IP address to listen on, defaults to every address
+	Port             int           //UDP and TCP port to listen on, 0 picks a free port
+	Realm            string        //defaults to `palette`
+	Secret           string        //shared secret that credentials are signed with, defaults to a random secret
+	TTL              time.Duration //lifetime of the credentials of a session, defaults to `DEFAULT_CREDENTIAL_TTL`
+	MinPort, MaxPort uint16        //range of ports relayed connections are allocated from, any port if both are 0
+}
+
+/*
+	Server is a TURN/STUN server that relays the WebRTC connections of users that cannot connect directly, ie.
+	behind symmetric NAT or a firewall that blocks UDP.
+
+	The server does not have any accounts. Instead, every session is given its own credentials by `Credentials()`
+	which are signed with the secret of the server and expire after `Config.TTL`, in the form of the TURN REST API:
+	the username is `<expiry>:<session>` and the password is the base64 HMAC-SHA1 of the username. The expiry only
+	applies to new clients: a client that was let in before its credentials expired keeps refreshing its allocation,
+	permissions and channels with the same credentials for as long as its connection lasts.
+*/
+type Server struct {
+	*turn.Server
+	config  Config
+	urls    []string
+	clients map[string]time.Time //last time every client that was let in was heard from, keyed by address and username
+	pruned  time.Time            //last time idle clients were forgotten
+	sync.Mutex
+}
+
+//Constructor for a TURN/STUN server that starts listening right away. Returns an error if
+//`PublicIP` is not a valid IP address or the server is unable to listen on the configured port
+func New(config Config) (*Server, error) {
+	publicIP := net.ParseIP(config.PublicIP)
+	if publicIP == nil {
+		return nil, fmt.Errorf(`unable to start TURN server: invalid public IP: '%v'`, config.PublicIP)
+	}
+	if config.Address == `` {
+		config.Address = `0.0.0.0`
+	}
+	if config.Realm == `` {
+		config.Realm = `palette`
+	}
+	if config.Secret == `` {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		config.Secret = hex.EncodeToString(secret)
+	}
+	if config.TTL <= 0 {
+		config.TTL = DEFAULT_CREDENTIAL_TTL
+	}
+	udp, e := net.ListenPacket(`udp4`, net.JoinHostPort(config.Address, strconv.Itoa(config.Port)))
+	if e != nil {
+		return nil, fmt.Errorf(`unable to start TURN server: %v`, e)
+	}
+	config.Port = udp.LocalAddr().(*net.UDPAddr).Port //the port that was picked if it was 0
+	tcp, e := net.Listen(`tcp4`, net.JoinHostPort(config.Address, strconv.Itoa(config.Port)))
+	if e != nil {
+		udp.Close()
+		return nil, fmt.Errorf(`unable to start TURN server: %v`, e)
+	}
+	server := &Server{config: config, clients: make(map[string]time.Time), pruned: time.Now()}
+	turnServer, e := turn.NewServer(turn.ServerConfig{
+		Realm:             config.Realm,
+		AuthHandler:       server.authenticate,
+		PacketConnConfigs: []turn.PacketConnConfig{{PacketConn: udp, RelayAddressGenerator: server.relayAddresses(publicIP)}},
+		ListenerConfigs:   []turn.ListenerConfig{{Listener: tcp, RelayAddressGenerator: server.relayAddresses(publicIP)}},
+	})
+	if e != nil {
+		udp.Close()
+		tcp.Close()
+		return nil, fmt.Errorf(`unable to start TURN server: %v`, e)
+	}
+	server.Server = turnServer
+	host := net.JoinHostPort(config.PublicIP, strconv.Itoa(config.Port))
+	server.urls = []string{`stun:` + host, `turn:` + host + `?transport=udp`, `turn:` + host + `?transport=tcp`}
+	log.Printf(`TURN server listening on %v, announced as %v`, udp.LocalAddr(), host)
+	return server, nil
+}
+
+//relayAddresses returns the generator of the addresses of relayed connections. Internal use only!
+func (server *Server) relayAddresses(publicIP net.IP) turn.RelayAddressGenerator {
+	if server.config.MinPort == 0 && server.config.MaxPort == 0 {
+		return &turn.RelayAddressGeneratorStatic{RelayAddress: publicIP, Address: server.config.Address}
+	}
+	return &turn.RelayAddressGeneratorPortRange{
+		RelayAddress: publicIP,
+		Address:      server.config.Address,
+		MinPort:      server.config.MinPort,
+		MaxPort:      server.config.MaxPort,
+	}
+}
+
+//Port is an accessor for the port the server listens on
+func (server *Server) Port() int { return server.config.Port }
+
+//Credentials returns the ICE server of a session with credentials that are valid for `Config.TTL`.
+//`session` only identifies the session in the username, ie. the name of the user
+func (server *Server) Credentials(session string) webrtc.ICEServer {
+	username := fmt.Sprintf(`%v:%v`, time.Now().Add(server.config.TTL).Unix(), session)
+	return webrtc.ICEServer{
+		URLs:           server.urls,
+		Username:       username,
+		Credential:     server.password(username),
+		CredentialType: webrtc.ICECredentialTypePassword,
+	}
+}
+
+//password returns the password of a username signed with the secret of the server. Internal use only!
+func (server *Server) password(username string) string {
+	mac := hmac.New(sha1.New, []byte(server.config.Secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/*
+	authenticate is the `turn.AuthHandler` of the server. It accepts usernames from `Credentials()` and returns the key
+	of their password, which pion checks against the request.
+
+	pion authenticates every request of a client, including the refreshes of its allocation, with the same username
+	without telling which kind of request it is. Expired usernames are therefore still accepted from an address that
+	was let in while they were valid, unless it has not been heard from for `ALLOCATION_IDLE`, so that relayed
+	connections outlive their credentials.
+
+	As pion only checks the password after this handler returns, a client is remembered before it is known to be
+	genuine and anyone holding valid credentials can make up source addresses. The clients are therefore only looked
+	up once a username has expired and at most `MAX_CLIENTS` are remembered: once full, idle clients are forgotten
+	sooner and new clients are let in without being remembered until there is room again, so that clients which
+	are already relayed cannot be pushed out. Internal use only!
+*/
+func (server *Server) authenticate(username, realm string, source net.Addr) ([]byte, bool) {
+	expiry, e := strconv.ParseInt(strings.SplitN(username, `:`, 2)[0], 10, 64)
+	if e != nil {
+		return nil, false
+	}
+	now, client := time.Now(), source.String()+` `+username
+	server.Lock()
+	defer server.Unlock()
+	if now.Unix() > expiry {
+		if seen, known := server.clients[client]; !known || now.Sub(seen) > ALLOCATION_IDLE {
+			return nil, false
+		}
+	}
+	_, known := server.clients[client]
+	full := !known && len(server.clients) >= MAX_CLIENTS
+	if now.Sub(server.pruned) > time.Minute || (full && now.Sub(server.pruned) > time.Second) {
+		server.prune(now)
+	}
+	if known || len(server.clients) < MAX_CLIENTS {
+		server.clients[client] = now
+	}
+	return turn.GenerateAuthKey(username, realm, server.password(username)), true
+}
+
+//prune forgets the clients that have not been heard from for `ALLOCATION_IDLE`. The server must be locked by the
+//caller. Internal use only!
+func (server *Server) prune(now time.Time) {
+	for client, seen := range server.clients {
+		if now.Sub(seen) > ALLOCATION_IDLE {
+			delete(server.clients, client)
+		}
+	}
+	server.pruned = now
+}
@@ -0,0 +1,163 @@
+// Palette © Albert Bregonia 2021
+package signaling
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// The signaling package declares the messages exchanged over the signaling WebSocket of every user, see `SCHEMA`
+
+//VERSION is the version of the signaling protocol, incremented whenever a change breaks older clients
+const VERSION = 1
+
+//SCHEMA is the JSON Schema of every message of the protocol, which is served to the frontend and can be used to
+//generate its types. It must be kept in sync with the types of this package
+//go:embed Schema.json
+var SCHEMA []byte
+
+//Types of messages, see `Message`
+const (
+	HELLO       = `hello`       //client → server: `Hello`, must be the first message of the client
+	WELCOME     = `welcome`     //server → client: `Welcome`, in response to `hello`
+	OFFER       = `offer`       //server → client: `webrtc.SessionDescription`
+	ANSWER      = `answer`      //client → server: `webrtc.SessionDescription`, in response to an `offer`
+	ICE         = `ice`         //both ways: `webrtc.ICECandidateInit`
+	RESTART     = `restart`     //client → server: no data, the connection failed and the server should restart ICE
+	RENEGOTIATE = `renegotiate` //client → server: no data, the client added or removed a track and needs a new offer
+	FALLBACK    = `fallback`    //server → client: `Fallback`
+	CHANNEL     = `message`     //both ways: `ChannelMessage`, only once the session has fallen back
+	ERROR       = `error`       //server → client: `Error`, in response to the message that caused it if it had an ID
+)
+
+//Capabilities a client and server can support, only those supported by both are used in a session, see `Hello`
+const (
+	CAPABILITY_VOICE    = `voice`    //voice chat tracks are offered to the client
+	CAPABILITY_FALLBACK = `fallback` //channels are sent over the socket if WebRTC cannot connect
+)
+
+//CLOSE_NOT_A_MEMBER is the close code of the socket after a `NOT_A_MEMBER` error. Clients must not connect again,
+//unlike after any other close, as the user has left the lobby, was kicked from it or the lobby was deleted
+const CLOSE_NOT_A_MEMBER = 4000
+
+//CAPABILITIES are the capabilities of the server
+var CAPABILITIES = []string{CAPABILITY_VOICE, CAPABILITY_FALLBACK}
+
+/*
+	Message is the envelope of every message of the protocol:
+
+		{"type": "<type>", "id": 1, "re": 1, "data": {...}}
+
+	`Data` is the JSON of the type of the message, not a string of it. `ID` is chosen by the sender, unique within the
+	session for messages sent in that direction, and only needs to be set if the sender wants to correlate a response.
+	A response, ie. an `answer` to an `offer` or an `error` caused by a message, sets `Re` to the ID of the message it
+	responds to.
+*/
+type Message struct {
+	Type string          `json:"type"`
+	ID   uint64          `json:"id,omitempty"`
+	Re   uint64          `json:"re,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+//New creates a message of a type with the JSON of `data`, which may be `nil`
+func New(kind string, id, re uint64, data interface{}) Message {
+	msg := Message{Type: kind, ID: id, Re: re}
+	if data != nil {
+		msg.Data, _ = json.Marshal(data) //every type of the protocol can be encoded
+	}
+	return msg
+}
+
+//Decode decodes the data of a message into `data`. Returns an `Error` with the code `BAD_REQUEST` if it is invalid
+func (msg Message) Decode(data interface{}) error {
+	if e := json.Unmarshal(msg.Data, data); e != nil {
+		return Errorf(BAD_REQUEST, `invalid data of '%v': %v`, msg.Type, e)
+	}
+	return nil
+}
+
+//Hello is the first message of a client, with the version of the protocol it speaks and the capabilities it supports
+type Hello struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+//Welcome accepts the `Hello` of a client with the capabilities of the session and its ICE configuration, which the
+//client must use before it answers the first offer
+type Welcome struct {
+	Version      int                  `json:"version"`
+	Capabilities []string             `json:"capabilities"`
+	ICE          webrtc.Configuration `json:"ice"`
+}
+
+//Fallback tells the client that WebRTC could not connect and which channels are sent over the socket instead
+type Fallback struct {
+	Channels []string `json:"channels"`
+}
+
+//ChannelMessage is a message of a channel sent over the socket after falling back
+type ChannelMessage struct {
+	Channel string `json:"channel"`
+	Data    string `json:"data"`
+	Binary  bool   `json:"binary,omitempty"` //whether `Data` is base64 encoded binary data
+}
+
+//Code identifies the kind of an `Error`
+type Code string
+
+//Codes of errors
+const (
+	BAD_REQUEST         Code = `bad_request`         //the message or its data is malformed
+	UNSUPPORTED_VERSION Code = `unsupported_version` //the version of the client is not `VERSION`, the socket is closed
+	HANDSHAKE_REQUIRED  Code = `handshake_required`  //the first message was not `hello`, the socket is closed
+	UNKNOWN_TYPE        Code = `unknown_type`        //the type of the message is not part of the protocol
+	INVALID_STATE       Code = `invalid_state`       //the message is not allowed at this point of the session
+	NEGOTIATION_FAILED  Code = `negotiation_failed`  //an answer or ICE candidate was rejected by the peer connection
+	CONNECTION_FAILED   Code = `connection_failed`   //WebRTC could not connect and the client cannot fall back, the socket is closed
+	NOT_A_MEMBER        Code = `not_a_member`        //the user is no longer in the lobby, the socket is closed with `CLOSE_NOT_A_MEMBER`
+	INTERNAL            Code = `internal`            //the server failed, the socket is closed
+)
+
+//Error is an error frame sent to the client, it is also used as an error by the server
+type Error struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+}
+
+//Errorf creates an error with a code and a formatted message
+func Errorf(code Code, format string, args ...interface{}) *Error {
+	return &Error{code, fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string { return fmt.Sprintf(`%v: %v`, e.Code, e.Message) }
+
+//Fatal reports whether the session ends after the error
+func (e *Error) Fatal() bool {
+	switch e.Code {
+	case UNSUPPORTED_VERSION, HANDSHAKE_REQUIRED, CONNECTION_FAILED, NOT_A_MEMBER, INTERNAL:
+		return true
+	}
+	return false
+}
+
+//Negotiate returns the capabilities of a `Hello` that the server supports.
+//Returns an `Error` with the code `UNSUPPORTED_VERSION` if the client speaks another version of the protocol
+func Negotiate(hello Hello) ([]string, error) {
+	if hello.Version != VERSION {
+		return nil, Errorf(UNSUPPORTED_VERSION, `version %v is not supported, the server speaks version %v`, hello.Version, VERSION)
+	}
+	capabilities := make([]string, 0, len(CAPABILITIES))
+	for _, capability := range CAPABILITIES {
+		for _, requested := range hello.Capabilities {
+			if requested == capability {
+				capabilities = append(capabilities, capability)
+				break
+			}
+		}
+	}
+	return capabilities, nil
+}
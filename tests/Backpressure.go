@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"Palette/lobby/user"
+	"log"
+	"sync"
+	"time"
+)
+
+//peer is a fake channel to a peer that only sends the data it has buffered once it is told to catch up
+type peer struct {
+	buffered uint64
+	received []string
+	low      func()
+	blocked  chan struct{} //closed once the peer stops blocking on sends, `nil` if sends never block
+	sync.Mutex
+}
+
+func (p *peer) Label() string          { return `test` }
+func (p *peer) Send(data []byte) error { return p.SendText(string(data)) }
+func (p *peer) SendText(text string) error {
+	if p.blocked != nil {
+		<-p.blocked
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.buffered += uint64(len(text))
+	p.received = append(p.received, text)
+	return nil
+}
+func (p *peer) BufferedAmount() uint64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.buffered
+}
+func (p *peer) SetBufferedAmountLowThreshold(threshold uint64) {}
+func (p *peer) OnBufferedAmountLow(handler func())             { p.low = handler }
+
+//catchUp empties the buffer of the peer
+func (p *peer) catchUp() {
+	p.Lock()
+	p.buffered = 0
+	p.Unlock()
+	p.low()
+}
+
+//Backpressure ensures that sending over a `user.Queue` never blocks on a slow peer, that non-essential messages are
+//dropped while a peer is behind, that essential messages are delivered in order once it catches up and that a peer
+//which stays behind is disconnected. Returns false if any step fails.
+func Backpressure() bool {
+	limits := user.Watermarks{Low: 10, High: 100, Max: 1000, Stall: 500 * time.Millisecond}
+	message := string(make([]byte, 60))
+
+	//a peer that never finishes sending does not block the sender
+	blocking := &peer{blocked: make(chan struct{})}
+	queue := user.NewQueue(blocking, true, limits, nil)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		queue.SendText(message)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		log.Println(`Sending to a blocked peer took`, time.Since(start))
+		return false
+	}
+	close(blocking.blocked)
+	queue.Close()
+
+	//non-essential messages are dropped while the peer is behind, essential messages wait
+	slow, lossy := &peer{buffered: limits.High + 1}, &peer{buffered: limits.High + 1}
+	stuck := make(chan struct{})
+	essential := user.NewQueue(slow, true, limits, func() { close(stuck) })
+	nonEssential := user.NewQueue(lossy, false, limits, nil)
+	dropped := user.Metrics().Dropped
+	for _, text := range []string{`a`, `b`, `c`} {
+		essential.SendText(text)
+		nonEssential.SendText(text)
+	}
+	time.Sleep(50 * time.Millisecond)
+	slow.Lock()
+	lossy.Lock()
+	n := len(slow.received) + len(lossy.received)
+	lossy.Unlock()
+	slow.Unlock()
+	if n != 0 {
+		log.Println(n, `messages were sent to peers that are behind`)
+		return false
+	}
+	if user.Metrics().Dropped-dropped != 3 {
+		log.Println(`Non-essential messages were not dropped:`, user.Metrics().Dropped-dropped)
+		return false
+	}
+	slow.catchUp()
+	time.Sleep(50 * time.Millisecond)
+	slow.Lock()
+	received := slow.received
+	slow.Unlock()
+	if len(received) != 3 || received[0] != `a` || received[1] != `b` || received[2] != `c` {
+		log.Println(`Essential messages were not delivered in order:`, received)
+		return false
+	}
+	nonEssential.Close()
+
+	//a peer that stays behind is disconnected
+	slow.Lock()
+	slow.buffered = limits.High + 1
+	slow.Unlock()
+	essential.SendText(`d`)
+	essential.SendText(`e`)
+	select {
+	case <-stuck:
+	case <-time.After(2 * limits.Stall):
+		log.Println(`A stuck peer was not disconnected`)
+		return false
+	}
+	if essential.SendText(`f`) == nil {
+		log.Println(`A queue accepted messages after its peer was disconnected`)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+//go:build !windows
+
+package tests
+
+import (
+	"Palette/lobby"
+	"Palette/lobby/user"
+	"fmt"
+	"log"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+//IdleLobbies is a benchmark that creates `nLobbies` lobbies with a single connected host each and measures
+//how much CPU time the server spends while every lobby sits idle for `window`, along with the memory used per lobby.
+//An idle lobby should cost next to nothing as its `userManager()` goroutine sleeps until it has something to do.
+func IdleLobbies(nLobbies int, window time.Duration) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	manager := lobby.NewManager()
+	start := time.Now()
+	for i := 1; i <= nLobbies; i++ {
+		ID := fmt.Sprint(i)
+		manager.AddLobby(lobby.New(ID, ID, lobby.DefaultSettings(), 5*time.Minute, 0, user.New(ID)))
+	}
+	log.Printf(`Created %v lobbies in %v`, nLobbies, time.Since(start))
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	log.Printf(`%v active goroutines, %v bytes of heap per lobby`, runtime.NumGoroutine(), (after.HeapAlloc-before.HeapAlloc)/uint64(nLobbies))
+
+	cpuStart := cpuTime()
+	time.Sleep(window)
+	used := cpuTime() - cpuStart
+	log.Printf(`CPU time used while idle for %v: %v (%.2f%% of one core)`, window, used, 100*float64(used)/float64(window))
+}
+
+//cpuTime returns the total user and system CPU time used by this process
+func cpuTime() time.Duration {
+	usage := syscall.Rusage{}
+	syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
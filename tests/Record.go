@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"Palette/lobby"
+	"Palette/lobby/user"
+	"Palette/record"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+//Record records a lobby to a temporary directory while its host draws, chats and speaks, then ensures that the event
+//log and voice file of the recording are complete, that a lobby can be recorded again within the same second and
+//that recordings over the retention limits are deleted. Returns false if any step fails.
+func Record() bool {
+	directory, e := os.MkdirTemp(``, `palette-recordings`)
+	if e != nil {
+		log.Println(e)
+		return false
+	}
+	defer os.RemoveAll(directory)
+	config := record.Config{Directory: directory, MaxRecordings: 2}
+	var recording *record.Recording
+	host := user.New(`host`)
+	Lobby := lobby.New(`record`, `record`, lobby.DefaultSettings(), time.Minute, 10, host)
+	defer Lobby.Close()
+	Lobby.OnRecord(func(l *lobby.Lobby) (lobby.Recorder, error) {
+		r, e := record.Start(config, l.ID())
+		recording = r
+		return r, e
+	})
+	Lobby.Draw(host, []byte(`before`)) //already on the whiteboard once recording starts
+	if e := Lobby.UpdateSettings(`host`, []byte(`{"record": true}`)); e != nil {
+		log.Println(e)
+		return false
+	}
+	Lobby.Draw(host, []byte(`during`))
+	Lobby.Receive(host, []byte(`{"content": "hello"}`))
+	for i := uint16(0); i < 50; i++ {
+		recording.Voice(`host`, &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 111, SequenceNumber: i, Timestamp: uint32(i) * 960, SSRC: 1}, Payload: []byte{0xf8, 0xff, 0xfe}})
+	}
+	time.Sleep(100 * time.Millisecond) //chat is delivered by the lobby's goroutine
+	if e := Lobby.UpdateSettings(`host`, []byte(`{"record": false}`)); e != nil {
+		log.Println(e)
+		return false
+	}
+
+	//event log
+	file, e := os.Open(filepath.Join(recording.Directory(), record.EVENT_LOG))
+	if e != nil {
+		log.Println(e)
+		return false
+	}
+	defer file.Close()
+	events := []string{}
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		event := struct { //the data of the event is kept as-is
+			Type, User string
+			Data       json.RawMessage
+		}{}
+		if e := json.Unmarshal(scanner.Bytes(), &event); e != nil {
+			log.Println(e)
+			return false
+		}
+		if event.Type == `stroke` { //whiteboard data is base64 encoded
+			json.Unmarshal(event.Data, (*[]byte)(&event.Data))
+		}
+		events = append(events, fmt.Sprintf(`%v %v %s`, event.Type, event.User, event.Data))
+	}
+	expected := []string{`stroke host before`, `stroke host during`, `chat  {"id":1`, `voice host "voice-1.ogg"`}
+	if len(events) != len(expected) {
+		log.Println(`Unexpected events:`, events)
+		return false
+	}
+	for i := range expected {
+		if !strings.HasPrefix(events[i], expected[i]) {
+			log.Printf(`Unexpected event %v: '%v', expected '%v'`, i, events[i], expected[i])
+			return false
+		}
+	}
+
+	//voice file
+	voice, e := os.ReadFile(filepath.Join(recording.Directory(), fmt.Sprintf(record.VOICE_FORMAT, 1)))
+	if e != nil || !bytes.HasPrefix(voice, []byte(`OggS`)) {
+		log.Println(`Voice was not recorded:`, e)
+		return false
+	}
+
+	//retention, the recordings are started within the same second
+	for i := 0; i < 3; i++ {
+		r, e := record.Start(config, `retention`)
+		if e != nil {
+			log.Println(e)
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+		r.Close()
+	}
+	deadline := time.Now().Add(time.Second) //recordings are deleted in the background
+	for {
+		entries, _ := os.ReadDir(directory)
+		if len(entries) == config.MaxRecordings {
+			return true
+		}
+		if time.Now().After(deadline) {
+			log.Printf(`%v recordings were kept instead of %v`, len(entries), config.MaxRecordings)
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"Palette/relay"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+//Relay starts the built-in TURN/STUN server on the loopback interface and connects two WebRTC peers that are only
+//allowed to use relayed candidates, then sends a message over a DataChannel between them. It also ensures that
+//credentials which were tampered with or have expired are rejected, but that an allocation made before they expired
+//can still be used afterwards. Returns false if any step fails within `timeout`.
+func Relay(timeout time.Duration) bool {
+	server, e := relay.New(relay.Config{PublicIP: `127.0.0.1`, Address: `127.0.0.1`, TTL: time.Minute})
+	if e != nil {
+		log.Println(e)
+		return false
+	}
+	defer server.Close()
+
+	//rejected credentials
+	forged := server.Credentials(`forged`)
+	forged.Credential = `not the password`
+	if allocate(server.Port(), forged, 0) == nil {
+		log.Println(`Relay accepted forged credentials`)
+		return false
+	}
+	expired, e := relay.New(relay.Config{PublicIP: `127.0.0.1`, Address: `127.0.0.1`, TTL: time.Second})
+	if e != nil {
+		log.Println(e)
+		return false
+	}
+	defer expired.Close()
+	stale := expired.Credentials(`expired`)
+	if e := allocate(expired.Port(), stale, 2*time.Second); e != nil { //the expiry of credentials has a resolution of a second
+		log.Println(`Relay rejected an allocation after its credentials expired:`, e)
+		return false
+	}
+	if allocate(expired.Port(), stale, 0) == nil {
+		log.Println(`Relay accepted expired credentials`)
+		return false
+	}
+
+	//relayed connection
+	policy := webrtc.Configuration{ICETransportPolicy: webrtc.ICETransportPolicyRelay}
+	policy.ICEServers = []webrtc.ICEServer{server.Credentials(`offerer`)}
+	offerer, e := webrtc.NewPeerConnection(policy)
+	if e != nil {
+		log.Println(e)
+		return false
+	}
+	defer offerer.Close()
+	policy.ICEServers = []webrtc.ICEServer{server.Credentials(`answerer`)}
+	answerer, e := webrtc.NewPeerConnection(policy)
+	if e != nil {
+		log.Println(e)
+		return false
+	}
+	defer answerer.Close()
+	offerer.OnICECandidate(func(ice *webrtc.ICECandidate) {
+		if ice != nil {
+			answerer.AddICECandidate(ice.ToJSON())
+		}
+	})
+	answerer.OnICECandidate(func(ice *webrtc.ICECandidate) {
+		if ice != nil {
+			offerer.AddICECandidate(ice.ToJSON())
+		}
+	})
+	received := make(chan string, 1)
+	answerer.OnDataChannel(func(channel *webrtc.DataChannel) {
+		channel.OnMessage(func(msg webrtc.DataChannelMessage) { received <- string(msg.Data) })
+	})
+	channel, e := offerer.CreateDataChannel(`relay`, nil)
+	if e != nil {
+		log.Println(e)
+		return false
+	}
+	channel.OnOpen(func() { channel.SendText(`relayed`) })
+	offer, _ := offerer.CreateOffer(nil)
+	offerer.SetLocalDescription(offer)
+	answerer.SetRemoteDescription(offer)
+	answer, _ := answerer.CreateAnswer(nil)
+	answerer.SetLocalDescription(answer)
+	offerer.SetRemoteDescription(answer)
+	select {
+	case msg := <-received:
+		pair, _ := offerer.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+		log.Printf(`Received '%v' over %v`, msg, pair)
+		return pair != nil && pair.Local.Typ == webrtc.ICECandidateTypeRelay
+	case <-time.After(timeout):
+		log.Println(`Peers did not connect through the relay`)
+		return false
+	}
+}
+
+//allocate requests a relayed address from the TURN server listening on a loopback port with the given credentials.
+//If `wait` is set, a permission is created on the relayed address after waiting for it
+func allocate(port int, credentials webrtc.ICEServer, wait time.Duration) error {
+	conn, e := net.ListenPacket(`udp4`, `127.0.0.1:0`)
+	if e != nil {
+		return e
+	}
+	defer conn.Close()
+	address := net.JoinHostPort(`127.0.0.1`, strconv.Itoa(port))
+	client, e := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: address,
+		TURNServerAddr: address,
+		Username:       credentials.Username,
+		Password:       credentials.Credential.(string),
+		Realm:          `palette`,
+		Conn:           conn,
+	})
+	if e != nil {
+		return e
+	}
+	defer client.Close()
+	if e := client.Listen(); e != nil {
+		return e
+	}
+	relayed, e := client.Allocate()
+	if e != nil {
+		return e
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+		if _, e := relayed.WriteTo([]byte(`permission`), conn.LocalAddr()); e != nil {
+			relayed.Close()
+			return e
+		}
+	}
+	return relayed.Close()
+}
@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"Palette/lobby"
+	"Palette/lobby/user"
+	"Palette/timelapse"
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/gif"
+	"log"
+	"sync"
+	"time"
+)
+
+//whiteboard is a fake `strokes` channel that keeps the time every stroke arrived
+type whiteboard struct {
+	times []time.Time
+	sync.Mutex
+}
+
+func (w *whiteboard) Label() string              { return user.STROKES }
+func (w *whiteboard) SendText(text string) error { return w.Send([]byte(text)) }
+func (w *whiteboard) Send(data []byte) error {
+	w.Lock()
+	defer w.Unlock()
+	w.times = append(w.times, time.Now())
+	return nil
+}
+
+//arrivals returns the times strokes arrived since the last call
+func (w *whiteboard) arrivals() []time.Time {
+	w.Lock()
+	defer w.Unlock()
+	times := w.times
+	w.times = nil
+	return times
+}
+
+//Replay ensures that a replay of a lobby's whiteboard requested over the `strokes` channel keeps the pacing of the
+//drawing at a faster speed, that it can be skipped to the end and that a time-lapse of the whiteboard only has frames where the drawing changed, shown for as
+//long as the drawing paused, and that segments are narrowed to the maximum width. Returns false if any step fails.
+func Replay() bool {
+	host := user.New(`host`)
+	Lobby := lobby.New(`replay`, `replay`, lobby.DefaultSettings(), time.Minute, 10, host)
+	defer Lobby.Close()
+	segment := []byte(`{"x0": 100, "y0": 100, "x1": 200, "y1": 200, "color": "#f00", "width": 20}`)
+	for _, pause := range []time.Duration{0, 100 * time.Millisecond, 300 * time.Millisecond} {
+		time.Sleep(pause)
+		Lobby.Draw(host, segment)
+	}
+	channel := &whiteboard{}
+	host.SetChannel(user.STROKES, channel)
+
+	//4x speed
+	if Lobby.Draw(host, []byte(fmt.Sprintf(`{"replay": {"speed": %v}}`, lobby.MAX_REPLAY_SPEED+1))) == nil {
+		log.Println(`A replay faster than the maximum speed was allowed`)
+		return false
+	}
+	if e := Lobby.Draw(host, []byte(`{"replay": {"speed": 4}}`)); e != nil {
+		log.Println(e)
+		return false
+	}
+	time.Sleep(500 * time.Millisecond)
+	times := channel.arrivals()
+	if len(times) != 3 {
+		log.Printf(`%v strokes were replayed instead of 3`, len(times))
+		return false
+	}
+	first, second := times[1].Sub(times[0]), times[2].Sub(times[1]) //25ms and 75ms
+	if first < 15*time.Millisecond || second < 2*first || times[2].Sub(times[0]) > 250*time.Millisecond {
+		log.Printf(`Strokes were replayed %v and %v apart instead of 25ms and 75ms`, first, second)
+		return false
+	}
+
+	//skipping to the end
+	Lobby.Draw(host, []byte(`{"replay": {"speed": 1}}`))
+	time.Sleep(10 * time.Millisecond)
+	Lobby.Draw(host, []byte(`{"replay": {"speed": 0}}`))
+	time.Sleep(50 * time.Millisecond)
+	if n := len(channel.arrivals()); n != 3 {
+		log.Printf(`%v strokes were sent after skipping a replay instead of 3`, n)
+		return false
+	}
+
+	//time-lapse
+	start := time.Now()
+	strokes := []timelapse.Stroke{
+		{Time: start, Data: segment},
+		{Time: start.Add(100 * time.Millisecond), Data: []byte(`invalid`)}, //skipped
+		{Time: start.Add(400 * time.Millisecond), Data: segment},
+	}
+	options := timelapse.DefaultOptions()
+	options.Frames, options.Delay, options.Hold = 4, 100*time.Millisecond, 0
+	buffer := &bytes.Buffer{}
+	if e := timelapse.Render(buffer, strokes, options); e != nil {
+		log.Println(e)
+		return false
+	}
+	animation, e := gif.DecodeAll(buffer)
+	if e != nil {
+		log.Println(e)
+		return false
+	}
+	delays := []int{10, 30, 10} //blank, first stroke until the second frame with a stroke, last stroke
+	if len(animation.Delay) != len(delays) {
+		log.Printf(`The time-lapse has %v frames instead of %v`, len(animation.Delay), len(delays))
+		return false
+	}
+	for i := range delays {
+		if animation.Delay[i] != delays[i] {
+			log.Printf(`Frame %v is shown for %v0ms instead of %v0ms`, i, animation.Delay[i], delays[i])
+			return false
+		}
+	}
+	x, y := 150*options.Width/3840, 150*options.Height/2160 //middle of the segment
+	if r, g, b, _ := animation.Image[1].At(x, y).RGBA(); r>>8 != 0xff || g != 0 || b != 0 {
+		log.Println(`The stroke was not drawn in red:`, animation.Image[1].At(x, y))
+		return false
+	}
+	white := color.Palette(animation.Image[0].Palette).Convert(color.White)
+	if animation.Image[0].At(x, y) != white {
+		log.Println(`The whiteboard did not start blank`)
+		return false
+	}
+
+	//a segment far wider and longer than the whiteboard is drawn as a diagonal of the maximum width
+	buffer.Reset()
+	huge := []timelapse.Stroke{{Time: start, Data: []byte(`{"x0": -1e300, "y0": 0, "x1": 1e300, "y1": 1e300, "width": 1e300}`)}}
+	if e := timelapse.Render(buffer, huge, options); e != nil {
+		log.Println(e)
+		return false
+	}
+	if animation, e = gif.DecodeAll(buffer); e != nil {
+		log.Println(e)
+		return false
+	}
+	last := animation.Image[len(animation.Image)-1]
+	if last.At(0, options.Height-1) != white || last.At(options.Width/2, options.Height/2) == white {
+		log.Println(`The segment was not clamped to the whiteboard:`, last.Bounds())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package tests
+
+import (
+	"Palette/lobby"
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+//injections are payloads that would run script or alter the page if chat was rendered as markup
+var injections = []string{
+	`<script>alert(1)</script>`,
+	`<img src=x onerror=alert(1)>`,
+	`<b style='color: red'>Server:</b> you have been kicked`,
+	`"><svg onload=alert(1)>`,
+	`javascript:alert(1)`,
+	`<a href="javascript:alert(1)">click</a>`,
+	`&lt;script&gt;alert(1)&lt;/script&gt;`,
+	`<anmt><draw>`, //v1's in-band routing tags
+}
+
+//RichText ensures that user provided chat content can never be interpreted as markup. Every payload is sent through
+//the same parsing as a message from a user and then rendered, the rendered HTML must not contain a single tag or
+//attribute that came from the payload. Returns false if any payload was rendered as markup.
+func RichText() bool {
+	passed := true
+	for _, payload := range injections {
+		data, _ := json.Marshal(map[string]interface{}{
+			`content`:  payload,
+			`system`:   true, //users cannot pose as the server
+			`segments`: []lobby.Segment{{Text: payload, Style: `"><script>`}},
+		})
+		msg, e := lobby.ParseMessage(`<i>attacker</i>`, data)
+		if e != nil {
+			log.Printf(`FAIL: %q was rejected: %v`, payload, e)
+			passed = false
+			continue
+		}
+		rendered := msg.HTML()
+		if msg.System || len(msg.Segments) != 1 || msg.Segments[0].Style != lobby.PLAIN || msg.Segments[0].Text != payload {
+			log.Printf(`FAIL: %q was not parsed as plain text: %+v`, payload, msg)
+			passed = false
+		} else if strings.ContainsAny(rendered, `<>"'`) {
+			log.Printf(`FAIL: %q rendered as markup: %v`, payload, rendered)
+			passed = false
+		}
+	}
+	mention := lobby.Message{Segments: []lobby.Segment{{Text: `@x`, Mention: `"><script>alert(1)</script>`}}}
+	if rendered := mention.HTML(); strings.Contains(rendered, `<script>`) || strings.Count(rendered, `"`) != 4 {
+		log.Printf(`FAIL: mention rendered as markup: %v`, rendered)
+		passed = false
+	}
+	if passed {
+		log.Printf(`Successful test. %v payloads rendered inert`, len(injections)+1)
+	}
+	return passed
+}
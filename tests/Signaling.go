@@ -0,0 +1,75 @@
+package tests
+
+import (
+	"Palette/signaling"
+	"encoding/json"
+	"log"
+	"reflect"
+	"strings"
+)
+
+//Signaling ensures that the schema of the signaling protocol declares every field of the types of the `signaling`
+//package and every error code, and that the handshake only accepts the current version with the capabilities of the
+//server. Returns false if any step fails.
+func Signaling() bool {
+	schema := struct {
+		Defs map[string]struct {
+			Properties map[string]struct {
+				Enum []string `json:"enum"`
+			} `json:"properties"`
+		} `json:"$defs"`
+	}{}
+	if e := json.Unmarshal(signaling.SCHEMA, &schema); e != nil {
+		log.Println(`Invalid schema:`, e)
+		return false
+	}
+	for _, data := range []interface{}{signaling.Hello{}, signaling.Welcome{}, signaling.Fallback{}, signaling.ChannelMessage{}, signaling.Error{}} {
+		kind := reflect.TypeOf(data)
+		definition, ok := schema.Defs[kind.Name()]
+		if !ok {
+			log.Printf(`'%v' is not in the schema`, kind.Name())
+			return false
+		}
+		for i := 0; i < kind.NumField(); i++ {
+			name := strings.Split(kind.Field(i).Tag.Get(`json`), `,`)[0]
+			if _, ok := definition.Properties[name]; !ok {
+				log.Printf(`'%v.%v' is not in the schema`, kind.Name(), name)
+				return false
+			}
+		}
+	}
+	codes := schema.Defs[`Error`].Properties[`code`].Enum
+	for _, code := range []signaling.Code{
+		signaling.BAD_REQUEST, signaling.UNSUPPORTED_VERSION, signaling.HANDSHAKE_REQUIRED, signaling.UNKNOWN_TYPE,
+		signaling.INVALID_STATE, signaling.NEGOTIATION_FAILED, signaling.CONNECTION_FAILED, signaling.NOT_A_MEMBER, signaling.INTERNAL,
+	} {
+		if !strings.Contains(strings.Join(codes, ` `)+` `, string(code)+` `) {
+			log.Printf(`Error code '%v' is not in the schema`, code)
+			return false
+		}
+	}
+
+	//handshake
+	if _, e := signaling.Negotiate(signaling.Hello{Version: signaling.VERSION + 1}); e == nil || !e.(*signaling.Error).Fatal() {
+		log.Println(`An unsupported version was accepted`)
+		return false
+	}
+	capabilities, e := signaling.Negotiate(signaling.Hello{Version: signaling.VERSION, Capabilities: []string{`unknown`, signaling.CAPABILITY_FALLBACK}})
+	if e != nil || !reflect.DeepEqual(capabilities, []string{signaling.CAPABILITY_FALLBACK}) {
+		log.Println(`Unexpected capabilities:`, capabilities, e)
+		return false
+	}
+
+	//messages carry their data as JSON rather than a string of it
+	msg := signaling.New(signaling.FALLBACK, 1, 0, signaling.Fallback{Channels: []string{`chat`}})
+	bin, _ := json.Marshal(msg)
+	if string(bin) != `{"type":"fallback","id":1,"data":{"channels":["chat"]}}` {
+		log.Println(`Unexpected message:`, string(bin))
+		return false
+	}
+	if e := (signaling.Message{Type: signaling.ICE, Data: []byte(`"candidate"`)}).Decode(&signaling.Fallback{}); e == nil || e.(*signaling.Error).Code != signaling.BAD_REQUEST {
+		log.Println(`Invalid data was decoded:`, e)
+		return false
+	}
+	return true
+}
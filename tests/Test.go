@@ -18,8 +18,8 @@ func Manager(nLobbies int, manager *lobby.Manager, MAX_USER_TIMEOUT time.Duratio
 		ID := fmt.Sprint(i)
 		lobbyKey := ID
 		host := user.New(ID)
-		Lobby := lobby.New(lobbyKey, lobbyKey, MAX_USER_TIMEOUT, host) //create a new lobby
-		manager.AddLobby(Lobby)                                        //add that lobby to the manager's list of lobbies
+		Lobby := lobby.New(lobbyKey, lobbyKey, lobby.DefaultSettings(), MAX_USER_TIMEOUT, 0, host) //create a new lobby
+		manager.AddLobby(Lobby)                                                                    //add that lobby to the manager's list of lobbies
 
 		//add user tests
 		newHost := user.New(fmt.Sprint(i * 10)) //create a new user to be the new host
@@ -0,0 +1,208 @@
+package tests
+
+import (
+	"Palette/voice"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/logging"
+	"github.com/pion/rtp"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+)
+
+//Voice connects two pion peers to a `voice.Room` the same way the server does, over an in-memory network, and
+//ensures that the voice of one peer is forwarded to the other only while it is audible and that the other peer is
+//asked to renegotiate once the speaker leaves. Returns false if any step fails within `timeout`.
+func Voice(timeout time.Duration) bool {
+	router, e := vnet.NewRouter(&vnet.RouterConfig{CIDR: `10.0.0.0/24`, LoggerFactory: logging.NewDefaultLoggerFactory()})
+	if e != nil {
+		log.Println(e)
+		return false
+	}
+	defer router.Stop()                                       //after the peers are closed
+	peer := func(ip string) (*webrtc.PeerConnection, error) { //a peer connection on its own address of the network
+		network := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+		if e := router.AddNet(network); e != nil {
+			return nil, e
+		}
+		engine := webrtc.SettingEngine{}
+		engine.SetVNet(network)
+		media, interceptors := &webrtc.MediaEngine{}, &interceptor.Registry{}
+		if e := voice.Register(media, interceptors); e != nil {
+			return nil, e
+		}
+		api := webrtc.NewAPI(webrtc.WithSettingEngine(engine), webrtc.WithMediaEngine(media), webrtc.WithInterceptorRegistry(interceptors))
+		return api.NewPeerConnection(webrtc.Configuration{})
+	}
+	peers := make([]*webrtc.PeerConnection, 0, 4)
+	for _, ip := range []string{`10.0.0.1`, `10.0.0.2`, `10.0.0.3`, `10.0.0.4`} {
+		connection, e := peer(ip)
+		if e != nil {
+			log.Println(e)
+			return false
+		}
+		defer connection.Close()
+		peers = append(peers, connection)
+	}
+	aliceServer, aliceClient, bobServer, bobClient := peers[0], peers[1], peers[2], peers[3]
+	if e := router.Start(); e != nil {
+		log.Println(e)
+		return false
+	}
+
+	//the server offers and the clients answer, as over `SignalingSocket`
+	var audible int32 = 1
+	renegotiations := make(chan string, 16)
+	room := voice.NewRoom()
+	alice, e := room.Join(`alice`, aliceServer, func() bool { return atomic.LoadInt32(&audible) == 1 }, func() { renegotiations <- `alice` })
+	if e != nil {
+		log.Println(e)
+		return false
+	}
+	if _, e := room.Join(`bob`, bobServer, func() bool { return true }, func() { renegotiations <- `bob` }); e != nil {
+		log.Println(e)
+		return false
+	}
+	microphone, _ := webrtc.NewTrackLocalStaticRTP(voice.OPUS.RTPCodecCapability, `microphone`, `alice`)
+	if e := negotiate(aliceServer, aliceClient, microphone); e != nil {
+		log.Println(e)
+		return false
+	}
+	if e := negotiate(bobServer, bobClient, nil); e != nil {
+		log.Println(e)
+		return false
+	}
+	packets := make(chan string, 1024)
+	bobClient.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			if _, _, e := track.ReadRTP(); e != nil {
+				return
+			}
+			select {
+			case packets <- track.StreamID():
+			default:
+			}
+		}
+	})
+	go func() { //20ms of Opus silence at a time, as a browser would send
+		for sequence := uint16(0); ; sequence++ {
+			packet := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 111, SequenceNumber: sequence, Timestamp: uint32(sequence) * 960}, Payload: []byte{0xf8, 0xff, 0xfe}}
+			if microphone.WriteRTP(packet) != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	//bob renegotiates to receive alice's track, then hears her
+	select {
+	case name := <-renegotiations:
+		if name != `bob` {
+			log.Printf(`%v was asked to renegotiate instead of bob`, name)
+			return false
+		}
+	case <-time.After(timeout):
+		log.Println(`The track of alice was never forwarded`)
+		return false
+	}
+	if e := negotiate(bobServer, bobClient, nil); e != nil {
+		log.Println(e)
+		return false
+	}
+	select {
+	case stream := <-packets:
+		if stream != `alice` {
+			log.Printf(`Received voice of '%v' instead of alice`, stream)
+			return false
+		}
+	case <-time.After(timeout):
+		log.Println(`Bob never heard alice`)
+		return false
+	}
+
+	//nothing is forwarded while alice is muted
+	atomic.StoreInt32(&audible, 0)
+	time.Sleep(200 * time.Millisecond) //packets that were already forwarded may still arrive
+	for len(packets) > 0 {
+		<-packets
+	}
+	time.Sleep(500 * time.Millisecond)
+	if n := len(packets); n > 0 {
+		log.Printf(`Bob heard %v packets while alice was muted`, n)
+		return false
+	}
+	atomic.StoreInt32(&audible, 1)
+	select {
+	case <-packets:
+	case <-time.After(timeout):
+		log.Println(`Bob did not hear alice once she was unmuted`)
+		return false
+	}
+
+	//bob renegotiates once alice leaves
+	alice.Leave()
+	select {
+	case name := <-renegotiations:
+		if name != `bob` {
+			log.Printf(`%v was asked to renegotiate instead of bob`, name)
+			return false
+		}
+	case <-time.After(timeout):
+		log.Println(`Bob was not asked to renegotiate after alice left`)
+		return false
+	}
+	if room.Size() != 1 {
+		log.Println(`Alice is still in the room`)
+		return false
+	}
+	return true
+}
+
+var negotiations sync.Mutex
+
+//negotiate sends an offer of a server peer to a client peer and its answer back, the client publishes `track` if it is not `nil`
+func negotiate(server, client *webrtc.PeerConnection, track webrtc.TrackLocal) error {
+	negotiations.Lock()
+	defer negotiations.Unlock()
+	offer, e := server.CreateOffer(nil)
+	if e != nil {
+		return fmt.Errorf(`unable to offer: %v`, e)
+	}
+	gathered := webrtc.GatheringCompletePromise(server)
+	if e := server.SetLocalDescription(offer); e != nil {
+		return fmt.Errorf(`unable to offer: %v`, e)
+	}
+	<-gathered
+	if e := client.SetRemoteDescription(*server.LocalDescription()); e != nil {
+		return fmt.Errorf(`unable to answer: %v`, e)
+	}
+	if track != nil {
+		sender, e := client.AddTrack(track) //uses the transceiver offered by the server
+		if e != nil {
+			return fmt.Errorf(`unable to publish: %v`, e)
+		}
+		go func() {
+			buffer := make([]byte, 1500)
+			for {
+				if _, _, e := sender.Read(buffer); e != nil {
+					return
+				}
+			}
+		}()
+	}
+	answer, e := client.CreateAnswer(nil)
+	if e != nil {
+		return fmt.Errorf(`unable to answer: %v`, e)
+	}
+	gathered = webrtc.GatheringCompletePromise(client)
+	if e := client.SetLocalDescription(answer); e != nil {
+		return fmt.Errorf(`unable to answer: %v`, e)
+	}
+	<-gathered
+	return server.SetRemoteDescription(*client.LocalDescription())
+}
@@ -0,0 +1,179 @@
+// Palette © Albert Bregonia 2021
+package timelapse
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The timelapse package renders the whiteboard of a lobby as it was drawn into an animated GIF
+
+//Stroke is a message of whiteboard data along with the time it was drawn
+type Stroke struct {
+	Time time.Time
+	Data []byte
+}
+
+//Segment is the whiteboard data of a single stroke, a straight line in the coordinates of the whiteboard:
+//
+//	{"x0": 0, "y0": 0, "x1": 10, "y1": 10, "color": "#rrggbb", "width": 5}
+//
+//As strokes come from users, segments are clamped to the whiteboard and `Options.MaxWidth` before they are drawn
+type Segment struct {
+	X0    float64 `json:"x0"`
+	Y0    float64 `json:"y0"`
+	X1    float64 `json:"x1"`
+	Y1    float64 `json:"y1"`
+	Color string  `json:"color"` //CSS hex color, black if empty
+	Width float64 `json:"width"`
+}
+
+//Options are the dimensions and pacing of a time-lapse
+type Options struct {
+	Canvas        image.Point   //size of the whiteboard in the coordinates of its strokes
+	MaxWidth      float64       //width of the widest segment in the coordinates of the whiteboard, wider segments are narrowed
+	Width, Height int           //size of the GIF, the whiteboard is scaled to fit
+	Frames        int           //number of frames between the first and last stroke, spaced evenly in time
+	Delay         time.Duration //time each frame is shown, GIFs only support multiples of 10ms
+	Hold          time.Duration //time the finished drawing is shown before the time-lapse loops
+}
+
+//DefaultOptions returns the options of a time-lapse of the whiteboard of the frontend, about 10 seconds long
+func DefaultOptions() Options {
+	return Options{
+		Canvas:   image.Pt(3840, 2160),
+		MaxWidth: 100,
+		Width:    960,
+		Height:   540,
+		Frames:   100,
+		Delay:    100 * time.Millisecond,
+		Hold:     3 * time.Second,
+	}
+}
+
+/*
+	Render writes an animated GIF of strokes being drawn to `w`.
+
+	The frames are spread evenly over the time between the first and last stroke so that the pacing of the drawing is
+	preserved: pauses in the drawing are pauses in the time-lapse. Only the part of the whiteboard that changed is
+	stored in each frame. Strokes that are not a `Segment` are skipped. Returns an error if the GIF cannot be written
+*/
+func Render(w io.Writer, strokes []Stroke, options Options) error {
+	colors := palette.WebSafe
+	white := uint8(color.Palette(colors).Index(color.White))
+	canvas := image.NewPaletted(image.Rect(0, 0, options.Width, options.Height), colors)
+	for i := range canvas.Pix {
+		canvas.Pix[i] = white
+	}
+	animation := &gif.GIF{Config: image.Config{ColorModel: canvas.Palette, Width: options.Width, Height: options.Height}}
+	add := func(frame *image.Paletted, delay time.Duration) {
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, int(delay/(10*time.Millisecond)))
+		animation.Disposal = append(animation.Disposal, gif.DisposalNone) //every frame is drawn over the previous ones
+	}
+	add(clone(canvas, canvas.Bounds()), options.Delay)
+	if len(strokes) > 0 && options.Frames > 0 {
+		scale := math.Min(float64(options.Width)/float64(options.Canvas.X), float64(options.Height)/float64(options.Canvas.Y))
+		start, duration := strokes[0].Time, strokes[len(strokes)-1].Time.Sub(strokes[0].Time)
+		next := 0
+		for frame := 1; frame <= options.Frames; frame++ {
+			until := start.Add(duration * time.Duration(frame) / time.Duration(options.Frames))
+			changed := image.Rectangle{}
+			for ; next < len(strokes) && !strokes[next].Time.After(until); next++ {
+				segment := Segment{}
+				if json.Unmarshal(strokes[next].Data, &segment) != nil {
+					continue
+				}
+				changed = changed.Union(segment.clamp(options).draw(canvas, scale))
+			}
+			if changed.Empty() { //nothing was drawn, the previous frame is shown for longer
+				animation.Delay[len(animation.Delay)-1] += int(options.Delay / (10 * time.Millisecond))
+				continue
+			}
+			add(clone(canvas, changed), options.Delay)
+		}
+	}
+	animation.Delay[len(animation.Delay)-1] += int(options.Hold / (10 * time.Millisecond))
+	if e := gif.EncodeAll(w, animation); e != nil {
+		return fmt.Errorf(`unable to render time-lapse: %v`, e)
+	}
+	return nil
+}
+
+//clamp moves the ends of a segment onto the whiteboard and narrows it to the maximum width of a time-lapse, so that
+//the work of drawing it is bounded. Internal use only!
+func (segment Segment) clamp(options Options) Segment {
+	limit := func(value, max float64) float64 { return math.Max(0, math.Min(value, max)) }
+	width, height := float64(options.Canvas.X), float64(options.Canvas.Y)
+	segment.X0, segment.Y0 = limit(segment.X0, width), limit(segment.Y0, height)
+	segment.X1, segment.Y1 = limit(segment.X1, width), limit(segment.Y1, height)
+	segment.Width = limit(segment.Width, options.MaxWidth)
+	return segment
+}
+
+//draw draws a segment onto a canvas as a line with round caps, scaling it from the coordinates of the whiteboard.
+//Only the pixels of every row that are within the radius of the line through the segment are checked, so that the
+//work is proportional to the area of the line rather than its bounding box.
+//Returns the part of the canvas that was drawn over. Internal use only!
+func (segment Segment) draw(canvas *image.Paletted, scale float64) image.Rectangle {
+	index := uint8(canvas.Palette.Index(parseColor(segment.Color)))
+	x0, y0, x1, y1 := segment.X0*scale, segment.Y0*scale, segment.X1*scale, segment.Y1*scale
+	radius := math.Max(segment.Width*scale/2, 0.5)
+	bounds := image.Rect(
+		int(math.Floor(math.Min(x0, x1)-radius)), int(math.Floor(math.Min(y0, y1)-radius)),
+		int(math.Ceil(math.Max(x0, x1)+radius))+1, int(math.Ceil(math.Max(y0, y1)+radius))+1,
+	).Intersect(canvas.Bounds())
+	dx, dy := x1-x0, y1-y0
+	length := dx*dx + dy*dy
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		py := float64(y) + 0.5
+		minX, maxX := bounds.Min.X, bounds.Max.X
+		if dy != 0 { //where the row crosses the band of the radius around the line
+			from, to := x0+((py-y0)*dx-radius*math.Sqrt(length))/dy, x0+((py-y0)*dx+radius*math.Sqrt(length))/dy
+			minX = int(math.Max(float64(minX), math.Floor(math.Min(from, to))-1))
+			maxX = int(math.Min(float64(maxX), math.Ceil(math.Max(from, to))+1))
+		}
+		for x := minX; x < maxX; x++ {
+			px := float64(x) + 0.5
+			t := 0.0 //position of the closest point of the segment to the pixel
+			if length > 0 {
+				t = math.Max(0, math.Min(1, ((px-x0)*dx+(py-y0)*dy)/length))
+			}
+			if math.Hypot(px-(x0+t*dx), py-(y0+t*dy)) <= radius {
+				canvas.SetColorIndex(x, y, index)
+			}
+		}
+	}
+	return bounds
+}
+
+//clone copies part of a canvas into a new frame. Internal use only!
+func clone(canvas *image.Paletted, bounds image.Rectangle) *image.Paletted {
+	frame := image.NewPaletted(bounds, canvas.Palette)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ { //the palette is the same, so the indices of the pixels are copied as-is
+		copy(frame.Pix[frame.PixOffset(bounds.Min.X, y):frame.PixOffset(bounds.Max.X, y)], canvas.Pix[canvas.PixOffset(bounds.Min.X, y):])
+	}
+	return frame
+}
+
+//parseColor parses a CSS hex color such as `#f80` or `#ff8800`, returns black if it is invalid. Internal use only!
+func parseColor(hex string) color.Color {
+	hex = strings.TrimPrefix(hex, `#`)
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	rgb, e := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || e != nil {
+		return color.Black
+	}
+	return color.RGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 0xff}
+}
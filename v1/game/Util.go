@@ -3,6 +3,7 @@
 package game
 
 import (
+	"html"
 	"strings"
 	"time"
 )
@@ -20,14 +21,15 @@ func Hide(word string) string {
 	return hidden
 }
 
-//Space spaces out the underscores, spaces become '&ensp;' for a better view in HTML
+//Space spaces out the underscores, spaces become '&ensp;' for a better view in HTML.
+//Revealed letters are escaped as the result is rendered as HTML
 func Space(word string) string {
 	spaced := ``
 	for _, char := range word {
 		if char == 32 {
 			spaced += `&ensp;`
 		} else {
-			spaced += string(char) + ` `
+			spaced += html.EscapeString(string(char)) + ` `
 		}
 	}
 	return spaced
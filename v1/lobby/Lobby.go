@@ -6,6 +6,7 @@ import (
 	"Palette/game"
 	"Palette/player"
 	"fmt"
+	"html"
 	"log"
 	"runtime"
 	"sort"
@@ -104,7 +105,7 @@ func (lobby *Data) TimeCreated() time.Time {
 // [notify] is a boolean that represents whether or not to notify the lobby of the disconnect
 func (lobby *Data) Disconnect(player *player.Data, notify bool, deliberate bool) {
 	if notify {
-		lobby.messageAll(colorNegative, player.Name()+` has left the lobby`)
+		lobby.messageAll(colorNegative, html.EscapeString(player.Name())+` has left the lobby`)
 	}
 	if deliberate {
 		player.SetTimeDC(time.Now().Add(-(maxTimeOut + time.Second)))
@@ -185,7 +186,7 @@ func (lobby *Data) ChatReader(connection *websocket.Conn, username string) {
 		_, p = lobby.GetPlayer(username)
 	}
 	p.Connection().SetChat(connection)
-	lobby.messageAll(colorPositive, username+` has joined the lobby.`)
+	lobby.messageAll(colorPositive, html.EscapeString(username)+` has joined the lobby.`)
 	for { //handle messages until disconnect
 		if _, rawData, e := connection.ReadMessage(); e == nil { //send message down broadcast channel
 			msg := string(rawData)
@@ -198,11 +199,12 @@ func (lobby *Data) ChatReader(connection *websocket.Conn, username string) {
 			default: //send standard messages with a time stamp, highlighted name and message
 				if strings.EqualFold(msg, lobby.game.Word()) && lobby.game.Live() {
 					if connection != lobby.game.CurrentArtist().Chat() {
-						lobby.messageAll(`limegreen`, username+` has guessed the word correctly!`)
+						lobby.messageAll(`limegreen`, html.EscapeString(username)+` has guessed the word correctly!`)
 						p.SetPoints(p.Points() + 100)
 					}
 				} else {
-					lobby.chat <- fmt.Sprintf(`<b title='%v' style='color: %v'>%v</b> %v`, game.Now(), colorPositive, username, msg)
+					//user input is escaped as chat is rendered as HTML
+					lobby.chat <- fmt.Sprintf(`<b title='%v' style='color: %v'>%v</b> %v`, game.Now(), colorPositive, html.EscapeString(username), html.EscapeString(msg))
 				}
 			}
 		} else { //disconnect and end thread upon error
@@ -227,7 +229,7 @@ func (lobby *Data) PaintLoader(connection *websocket.Conn, username string) {
 			lobby.game.RemoveArtist(lobby.game.GetArtist(connection))
 			lobby.Disconnect(p, false, false)
 			if p.Connection().Chat() != nil { //if the chat is connected but an error occurs here; notify the lobby
-				lobby.chat <- fmt.Sprintf(`%v<b style='color: var(--highlight3)'>%v has encountered an error. Please ask them to refresh.</b>`, serverPrefix, p.Name())
+				lobby.chat <- fmt.Sprintf(`%v<b style='color: var(--highlight3)'>%v has encountered an error. Please ask them to refresh.</b>`, serverPrefix, html.EscapeString(p.Name()))
 			}
 			break
 		}
@@ -250,7 +252,7 @@ func (lobby *Data) runGame() {
 			for n := 0; n < len(lobby.game.Artists()); n++ {
 				max, _ := time.ParseDuration(fmt.Sprintf(`%vs`, lobby.game.Duration()))
 				lobby.game.ChooseWord()
-				lobby.chat <- fmt.Sprintf(`%v%v<b style='color: limegreen'>Your word is: <b>%v</b></b>`, currentArtistTag, serverPrefix, lobby.game.Word())
+				lobby.chat <- fmt.Sprintf(`%v%v<b style='color: limegreen'>Your word is: <b>%v</b></b>`, currentArtistTag, serverPrefix, html.EscapeString(lobby.game.Word()))
 				hint := game.Hide(lobby.game.Word())
 				lobby.chat <- fmt.Sprintf(`%v<b style='color: var(--highlight2)'>Hint: %v (%v)</b>`, messageAll, game.Space(hint), len(lobby.game.Word()))
 				for timeLeft := max; timeLeft > 0; timeLeft -= time.Second {
@@ -273,7 +275,7 @@ func (lobby *Data) runGame() {
 						time.Sleep(time.Second)
 					}
 				}
-				lobby.chat <- fmt.Sprintf(`%v<b style='color: var(--highlight2)'>Round Over. The word was <b style='color: limegreen'>%v</b></b>`, messageAll, lobby.game.Word())
+				lobby.chat <- fmt.Sprintf(`%v<b style='color: var(--highlight2)'>Round Over. The word was <b style='color: limegreen'>%v</b></b>`, messageAll, html.EscapeString(lobby.game.Word()))
 				time.Sleep(5 * time.Second)
 				lobby.game.NextArtist()
 			}
@@ -308,7 +310,7 @@ func (lobby *Data) ParseCommand(host bool, cmd string, connection *websocket.Con
 			players := `List of Players:<br>`
 			lobby.RLock()
 			for _, p := range lobby.players {
-				players += fmt.Sprintf(`<b>%v<b> %v<br>`, p.Points(), p.Name())
+				players += fmt.Sprintf(`<b>%v<b> %v<br>`, p.Points(), html.EscapeString(p.Name()))
 			}
 			lobby.RUnlock()
 			msg += players
@@ -329,14 +331,14 @@ func (lobby *Data) ParseCommand(host bool, cmd string, connection *websocket.Con
 						msg = fmt.Sprintf(`Successfully updated word list: <b style='color: limegreen'>%v</b>`, *wordList)
 					case `add`:
 						lobby.game.AddWord(&args[2])
-						msg = fmt.Sprintf(`Successfully added word to word list: <b style='color: limegreen'>%v</b>`, args[2])
+						msg = fmt.Sprintf(`Successfully added word to word list: <b style='color: limegreen'>%v</b>`, html.EscapeString(args[2]))
 					case `add-all`:
 						words, wordList := parseWords(&args[2])
 						lobby.game.AddWords(words)
 						msg = fmt.Sprintf(`Successfully added words to word list: <b style='color: limegreen'>%v</b>`, *wordList)
 					case `remove`:
 						lobby.game.RemoveWord(&args[2])
-						msg = fmt.Sprintf(`Successfully removed word from word list: <b style='color: limegreen'>%v</b>`, args[2])
+						msg = fmt.Sprintf(`Successfully removed word from word list: <b style='color: limegreen'>%v</b>`, html.EscapeString(args[2]))
 					case `remove-all`:
 						words, wordList := parseWords(&args[2])
 						lobby.game.RemoveWords(words)
@@ -346,7 +348,7 @@ func (lobby *Data) ParseCommand(host bool, cmd string, connection *websocket.Con
 			} else { //non-hosts can only list the words
 				wordList := ``
 				for i, word := range lobby.game.Words() {
-					wordList += fmt.Sprintf(`%v. "%v"<br>`, i, word)
+					wordList += fmt.Sprintf(`%v. "%v"<br>`, i, html.EscapeString(word))
 				}
 				msg = fmt.Sprintf(`Word list: <br><b style='color: var(--highlight2)'>%v</b>`, wordList)
 			}
@@ -431,7 +433,7 @@ func parseWords(rawWords *string) (*[]string, *string) {
 	wordList := ``
 	for n := range words {
 		words[n] = strings.TrimSpace(words[n])
-		wordList += fmt.Sprintf(`"%v"<br>`, words[n])
+		wordList += fmt.Sprintf(`"%v"<br>`, html.EscapeString(words[n]))
 	}
 	return &words, &wordList
 }
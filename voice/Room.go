@@ -0,0 +1,222 @@
+// Palette © Albert Bregonia 2021
+package voice
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// The voice package forwards the voice of every member of a room to every other member, without mixing or decoding it
+
+//OPUS is the codec of every voice track
+var OPUS = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeOpus,
+		ClockRate:   48000,
+		Channels:    2,
+		SDPFmtpLine: `minptime=10;useinbandfec=1`,
+	},
+	PayloadType: 111,
+}
+
+//Register registers the voice codec and the default interceptors, such as RTCP reports and NACKs, with the media
+//engine and interceptor registry of a WebRTC API. Peer connections of an API without them cannot join a room
+func Register(engine *webrtc.MediaEngine, interceptors *interceptor.Registry) error {
+	if e := engine.RegisterCodec(OPUS, webrtc.RTPCodecTypeAudio); e != nil {
+		return fmt.Errorf(`unable to register voice codec: %v`, e)
+	}
+	if e := webrtc.RegisterDefaultInterceptors(engine, interceptors); e != nil {
+		return fmt.Errorf(`unable to register voice interceptors: %v`, e)
+	}
+	return nil
+}
+
+/*
+	Room is the voice chat of a group of peer connections, ie. a lobby.
+
+	Every member publishes at most one Opus track which the server forwards packet by packet to every other member of
+	the room, as a selective forwarding unit (SFU) would. Each forwarded track is added to the peer connection of every
+	other member with a stream ID of the name of its publisher, so that clients can tell who is speaking. As tracks come
+	and go, members are asked to renegotiate their peer connection.
+*/
+type Room struct {
+	members  map[*Member]bool
+	onPacket func(name string, packet *rtp.Packet) //receives every packet that is forwarded, see `OnPacket()`
+	sync.Mutex
+}
+
+//NewRoom is the constructor for an empty room
+func NewRoom() *Room {
+	return &Room{members: make(map[*Member]bool)}
+}
+
+//OnPacket sets the handler that receives every packet forwarded by a room along with the name of its publisher, ie.
+//to record the room. The handler must not keep the packet. It must be set before the first member joins
+func (room *Room) OnPacket(handler func(name string, packet *rtp.Packet)) {
+	room.Lock()
+	defer room.Unlock()
+	room.onPacket = handler
+}
+
+//Size returns the number of members in a room
+func (room *Room) Size() int {
+	room.Lock()
+	defer room.Unlock()
+	return len(room.members)
+}
+
+//Member is a peer connection that has joined a room
+type Member struct {
+	room        *Room
+	name        string
+	peer        *webrtc.PeerConnection
+	audible     func() bool //whether the voice of the member is forwarded, ie. they are not muted
+	renegotiate func()      //asks the client of the member for a new answer, see `Join()`
+	track       *webrtc.TrackLocalStaticRTP
+	senders     map[*Member]*webrtc.RTPSender //senders of the tracks of the other members this member receives
+}
+
+/*
+	Join adds a peer connection to a room before it has been negotiated.
+
+	The peer connection is given a transceiver to publish the voice of the member and the tracks of every other member
+	of the room. Packets of the member are only forwarded while `audible` returns true. `renegotiate` is called whenever
+	tracks are added to or removed from the peer connection after it was negotiated, in which case the server must send
+	a new offer to the client. Returns an error if the peer connection does not support the voice codec, see `Register()`.
+*/
+func (room *Room) Join(name string, peer *webrtc.PeerConnection, audible func() bool, renegotiate func()) (*Member, error) {
+	member := &Member{
+		room:        room,
+		name:        name,
+		peer:        peer,
+		audible:     audible,
+		renegotiate: renegotiate,
+		senders:     make(map[*Member]*webrtc.RTPSender),
+	}
+	if _, e := peer.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); e != nil {
+		return nil, fmt.Errorf(`unable to join voice chat as '%v': %v`, name, e)
+	}
+	room.Lock()
+	defer room.Unlock()
+	for other := range room.members {
+		if other.track == nil {
+			continue
+		}
+		if e := member.receive(other); e != nil {
+			return nil, fmt.Errorf(`unable to join voice chat as '%v': %v`, name, e)
+		}
+	}
+	room.members[member] = true
+	peer.OnTrack(member.publish)
+	return member, nil
+}
+
+//Leave removes a member and their track from a room. The peer connection of the member is left as-is
+func (member *Member) Leave() {
+	room := member.room
+	room.Lock()
+	if !room.members[member] {
+		room.Unlock()
+		return
+	}
+	delete(room.members, member)
+	affected := member.unpublish()
+	room.Unlock()
+	for _, other := range affected {
+		other.renegotiate()
+	}
+}
+
+//publish forwards the voice of a member to every other member of their room until the track ends. Internal use only!
+func (member *Member) publish(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	if remote.Kind() != webrtc.RTPCodecTypeAudio {
+		return
+	}
+	track, e := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, `voice`, member.name)
+	if e != nil {
+		return
+	}
+	room := member.room
+	room.Lock()
+	if !room.members[member] { //the member left while their track was arriving
+		room.Unlock()
+		return
+	}
+	affected := member.unpublish() //a member only has a single voice, ie. after switching microphones
+	member.track = track
+	for other := range room.members {
+		if other != member && other.receive(member) == nil {
+			affected = append(affected, other)
+		}
+	}
+	onPacket := room.onPacket
+	room.Unlock()
+	for _, other := range affected {
+		other.renegotiate()
+	}
+	for {
+		packet, _, e := remote.ReadRTP()
+		if e != nil {
+			break
+		}
+		if !member.audible() {
+			continue
+		}
+		track.WriteRTP(packet) //errors only occur for receivers that have gone away, which are removed by `Leave()`
+		if onPacket != nil {
+			onPacket(member.name, packet)
+		}
+	}
+	room.Lock()
+	if member.track == track {
+		affected = member.unpublish()
+	} else {
+		affected = nil
+	}
+	room.Unlock()
+	for _, other := range affected {
+		other.renegotiate()
+	}
+}
+
+//receive adds the track of another member to the peer connection of a member. The room must be locked. Internal use only!
+func (member *Member) receive(other *Member) error {
+	transceiver, e := member.peer.AddTransceiverFromTrack(other.track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	if e != nil {
+		return e
+	}
+	sender := transceiver.Sender()
+	member.senders[other] = sender
+	go func() { //RTCP has to be read for the interceptors to work
+		buffer := make([]byte, 1500)
+		for {
+			if _, _, e := sender.Read(buffer); e != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+//unpublish removes the track of a member from every other member of their room and returns the members that have to
+//renegotiate. The room must be locked. Internal use only!
+func (member *Member) unpublish() []*Member {
+	if member.track == nil {
+		return nil
+	}
+	member.track = nil
+	affected := make([]*Member, 0, len(member.room.members))
+	for other := range member.room.members {
+		if sender := other.senders[member]; sender != nil {
+			delete(other.senders, member)
+			if other.peer.RemoveTrack(sender) == nil {
+				affected = append(affected, other)
+			}
+		}
+	}
+	return affected
+}